@@ -0,0 +1,331 @@
+// Account settings: changing the password, and the email address that
+// password reset links are sent to.
+//
+// People who forgot their password can ask for a reset link from /forgot.
+// The link carries a random token that works once, until
+// passwordResetDuration has passed. Only a hash of each token is stored,
+// so the tokens can't be read back out of the database.
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Size of password reset tokens
+const resetTokenSizeBytes = 32
+
+// Entry point for requests to /account and /account/{password|email}
+func handleAccountRequest(response http.ResponseWriter, request *http.Request, username string) {
+	switch {
+	case request.URL.Path == "/account" && request.Method == "GET":
+		showAccount(response, username)
+	case request.URL.Path == "/account/password" && request.Method == "POST":
+		changePassword(response, request, username)
+	case request.URL.Path == "/account/email" && request.Method == "POST":
+		changeEmail(response, request, username)
+
+	default:
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "not found")
+	}
+}
+
+// Return the email address of the given user, or "" if they haven't given one
+func userEmail(username string) (string, error) {
+	var address string
+	err := db.QueryRow("SELECT address FROM emails WHERE username = ?", username).Scan(&address)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return address, err
+}
+
+// Show the forms for changing the user's password and email address
+func showAccount(response http.ResponseWriter, username string) {
+	address, err := userEmail(username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Username": username,
+		"Email":    address,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/account.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Replace a user's password
+func setPassword(username, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE users SET password = ?, salt = '' WHERE username = ?", hashedPassword, username)
+	return err
+}
+
+// Log a user out everywhere, except for the session with the given token
+func endSessions(username, keepToken string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE username = ? AND token != ?", username, keepToken)
+	return err
+}
+
+// Change the user's password once they have entered their current one,
+// logging them out everywhere else. Wrong passwords count as failed logins,
+// so a stolen session can't be used to guess the password.
+func changePassword(response http.ResponseWriter, request *http.Request, username string) {
+	password := request.FormValue("new_password")
+
+	if !claimLoginAttempt(response, request, username) {
+		return
+	}
+	correct, err := checkPassword(username, request.FormValue("current_password"))
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if !correct {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "incorrect password")
+		return
+	}
+	loginSucceeded(request, username)
+	if err := checkPasswordPolicy(username, password); err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	// the user's own session is the one the request came with
+	var keepToken string
+	if cookie, err := request.Cookie("session_token"); err == nil {
+		keepToken = cookie.Value
+	}
+	err = setPassword(username, password)
+	if err == nil {
+		err = endSessions(username, keepToken)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/account", http.StatusFound)
+}
+
+// Set the email address reset links are sent to, or remove it if the form
+// value email is empty
+func changeEmail(response http.ResponseWriter, request *http.Request, username string) {
+	value := request.FormValue("email")
+
+	var err error
+	if value == "" {
+		_, err = db.Exec("DELETE FROM emails WHERE username = ?", username)
+	} else {
+		address, parseErr := mail.ParseAddress(value)
+		if parseErr != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, "invalid email address")
+			return
+		}
+		_, err = db.Exec("INSERT OR REPLACE INTO emails (username, address) VALUES (?, ?)", username, address.Address)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/account", http.StatusFound)
+}
+
+// Return the hash a password reset token is stored as. Tokens are random,
+// so unlike passwords they don't need a slow hash.
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Return the address the site is reached at, for links in email
+func siteURL() string {
+	if url := os.Getenv(siteURLVariable); url != "" {
+		return url
+	}
+	return "http://localhost:" + strconv.Itoa(httpPort)
+}
+
+// Handle POST /forgot: mail a password reset link to the account given by
+// the form value username. The response is the same whether or not the
+// account exists and has an email address, so it can't be used to find
+// out either. The link is sent in the background, so the response doesn't
+// take longer for accounts that get one.
+func requestPasswordReset(response http.ResponseWriter, request *http.Request) {
+	username := request.FormValue("username")
+
+	go func() {
+		err := sendPasswordReset(username)
+		if err != nil {
+			log.Error(err)
+		}
+	}()
+
+	showPasswordPage(response, "forgot", map[string]interface{}{
+		"Sent": true,
+	})
+}
+
+// Mail a new password reset link to a user, unless they have no email
+// address or were sent one less than passwordResetRequestInterval ago
+func sendPasswordReset(username string) error {
+	address, err := userEmail(username)
+	if err != nil || address == "" {
+		return err
+	}
+
+	var recent int
+	err = db.QueryRow("SELECT COUNT(*) FROM password_resets WHERE username = ? AND created > ?",
+		username, time.Now().Add(-passwordResetRequestInterval).Unix()).Scan(&recent)
+	if err != nil || recent > 0 {
+		return err
+	}
+
+	token, err := randomByteString(resetTokenSizeBytes)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = db.Exec("DELETE FROM password_resets WHERE expires <= ?", now.Unix())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO password_resets (token, username, created, expires) VALUES (?, ?, ?, ?)",
+		hashResetToken(token), username, now.Unix(), now.Add(passwordResetDuration).Unix())
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Someone asked to reset the password of your account %s.\n\n"+
+		"To choose a new password, open this link within %d minutes:\n\n%s/reset-password?token=%s\n\n"+
+		"If that wasn't you, you can ignore this message.\n", username, int(passwordResetDuration/time.Minute), siteURL(), token)
+	return mailer.Send(address, "Reset your password", body)
+}
+
+// Return the user a password reset token belongs to.
+// Returns sql.ErrNoRows if the token is unknown, used or expired.
+func lookupResetToken(token string) (username string, err error) {
+	row := db.QueryRow("SELECT username FROM password_resets WHERE token = ? AND expires > ?", hashResetToken(token), time.Now().Unix())
+	err = row.Scan(&username)
+	return
+}
+
+// Handle GET /reset-password: show the form for choosing a new password
+func showPasswordReset(response http.ResponseWriter, request *http.Request) {
+	token := request.URL.Query().Get("token")
+
+	_, err := lookupResetToken(token)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "invalid or expired reset link")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	showPasswordPage(response, "resetpassword", map[string]interface{}{
+		"Token": token,
+	})
+}
+
+// Handle POST /reset-password: set a new password using a reset token,
+// logging the user out everywhere
+func resetPassword(response http.ResponseWriter, request *http.Request) {
+	token := request.FormValue("token")
+	password := request.FormValue("password")
+
+	username, err := lookupResetToken(token)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "invalid or expired reset link")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if err := checkPasswordPolicy(username, password); err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		showPasswordPage(response, "resetpassword", map[string]interface{}{
+			"Token": token,
+			"Error": err.Error(),
+		})
+		return
+	}
+
+	// use up the token, unless another request already did
+	result, err := db.Exec("DELETE FROM password_resets WHERE token = ?", hashResetToken(token))
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "invalid or expired reset link")
+		return
+	}
+
+	err = setPassword(username, password)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM password_resets WHERE username = ?", username)
+	}
+	if err == nil {
+		err = endSessions(username, "")
+	}
+	if err == nil {
+		err = accountThrottle.reset(username)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/login", http.StatusFound)
+}
+
+// Show one of the pages of the password reset flow
+func showPasswordPage(response http.ResponseWriter, templateName string, data map[string]interface{}) {
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/"+templateName+".html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
@@ -6,16 +6,20 @@ package main
 // This includes golang.org/x/
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	_ "io/ioutil"
+	"mime/multipart"
 	"net/http"
-	_ "os"
-	"path/filepath"
+	"net/url"
+	"os"
 	_ "path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -25,28 +29,35 @@ func processRegistration(response http.ResponseWriter, request *http.Request) {
 	username := request.FormValue("username")
 	password := request.FormValue("password")
 
+	err := checkUsernamePolicy(username)
+	if err == nil {
+		err = checkPasswordPolicy(username, password)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		showPage(response, "register", NewPageData("", err.Error()))
+		return
+	}
+
 	// Check if username already exists
 	row := db.QueryRow("SELECT username FROM users WHERE username = ?", username)
 	var savedUsername string
-	err := row.Scan(&savedUsername)
+	err = row.Scan(&savedUsername)
 	if err != sql.ErrNoRows {
 		response.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(response, "username %s already exists", savedUsername)
+		showPage(response, "register", NewPageData("", fmt.Sprintf("The username %s is already taken.", savedUsername)))
 		return
 	}
 
-	// Generate salt
-	const saltSizeBytes = 16
-	salt, err := randomByteString(saltSizeBytes)
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		response.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(response, err.Error())
 		return
 	}
 
-	hashedPassword := hashPassword(password, salt)
-
-	_, err = db.Exec("INSERT INTO users VALUES (NULL, ?, ?, ?)", username, hashedPassword, salt)
+	// the salt is part of the hash
+	_, err = db.Exec("INSERT INTO users VALUES (NULL, ?, ?, '')", username, hashedPassword)
 
 	if err != nil {
 		response.WriteHeader(http.StatusInternalServerError)
@@ -66,29 +77,34 @@ func processLoginAttempt(response http.ResponseWriter, request *http.Request) {
 	username := request.FormValue("username")
 	password := request.FormValue("password")
 
-	row := db.QueryRow("SELECT password, salt FROM users WHERE username = ?", username)
-
-	// Parse database response: check for no response or get values
-	var encodedHash, encodedSalt string
-	err := row.Scan(&encodedHash, &encodedSalt)
-	if err == sql.ErrNoRows {
-		response.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(response, "unknown user")
+	if !claimLoginAttempt(response, request, username) {
 		return
-	} else if err != nil {
+	}
+
+	// unknown users and wrong passwords get the same response
+	correct, err := checkPassword(username, password)
+	if err != nil && err != sql.ErrNoRows {
 		response.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(response, err.Error())
 		return
 	}
+	if !correct {
+		loginFailed(response)
+		return
+	}
 
-	// Hash submitted password with salt to allow for comparison
-	submittedPassword := hashPassword(password, encodedSalt)
-
-	// Verify password
-	if submittedPassword != encodedHash {
-		fmt.Fprintf(response, "incorrect password")
+	// users with two-factor authentication still need to enter a code
+	enabled, err := twoFactorEnabled(username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
 		return
 	}
+	if enabled {
+		startTwoFactorLogin(response, username)
+		return
+	}
+	loginSucceeded(request, username)
 
 	// Set a new session cookie
 	initSession(response, username)
@@ -138,91 +154,466 @@ func processUpload(response http.ResponseWriter, request *http.Request, username
 	//////////////////////////////////
 
 	// HINT: files should be stored in const filePath = "./files"
-	// get file
-	file, header, err := request.FormFile("file")
+	// limit the size of the request body, so that reading past
+	// maxUploadSize fails instead of filling up the disk
+	request.Body = http.MaxBytesReader(response, request.Body, maxUploadSize)
+
+	// get file, streaming the multipart body rather than buffering it in memory
+	file, fields, err := nextFilePart(request)
 	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	defer file.Close()
+
+	// an upload either replaces an existing file with a new version, or
+	// adds a file to one of the user's own folders
+	folderID := fields["folder"]
+	replaceID := fields["replace"]
+	filename := file.FileName()
+
+	// the upload is charged to the owner of the file
+	owner := username
+	if replaceID != "" {
+		owner, err = checkEditor(username, replaceID)
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+	} else {
+		err = checkFolderOwner(username, folderID)
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+
+		// extract file name and veirfy
+		if !validFilename(filename) {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(response, "invalid file name")
+			return
+		}
 	}
 
-	// extract file name and veirfy
-	filename := header.Filename
-	matched, _ := regexp.MatchString("^(?:[[:alnum:]]|[.]){1,50}$", filename)
-	if !matched {
+	// stream contents to the blob store, charged to the owner's quota
+	digest, size, ok := storeUpload(response, file, owner)
+	if !ok {
+		return
+	}
+
+	// update files database table
+	if replaceID != "" {
+		err = replaceFile(owner, username, replaceID, digest, size)
+	} else {
+		_, err = addFile(username, folderID, filename, digest, size, true)
+	}
+	if err == errQuotaExceeded {
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprint(response, quotaExceededMessage(owner))
+		return
+	} else if err != nil {
 		response.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(response, "invalid file name")
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if replaceID != "" {
+		http.Redirect(response, request, "/list", http.StatusFound)
+		return
 	}
+	redirectToFolder(response, request, folderID)
 
-	// extract file contents
-	filecontents, err := ioutil.ReadAll(file)
+	//////////////////////////////////
+	// END TASK 3: YOUR CODE HERE
+	//////////////////////////////////
+}
+
+// Stream an uploaded file to the blob store, reusing an identical blob if
+// there is one, and stopping as soon as it goes over the owner's quota.
+// Writes an error response and returns false if the file could not be stored.
+func storeUpload(response http.ResponseWriter, file io.Reader, owner string) (digest string, size int64, ok bool) {
+	remaining, err := quotaRemaining(owner)
 	if err != nil {
 		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return "", 0, false
 	}
-	filecontents = []byte(filecontents)
 
-	// create file path
-	filepath := filepath.Join("./files", filename)
+	digest, size, err = storeBlob(&quotaReader{reader: file, remaining: remaining})
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(response, "file exceeds the maximum upload size of %d bytes", maxUploadSize)
+		return "", 0, false
+	} else if err == errQuotaExceeded {
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprint(response, quotaExceededMessage(owner))
+		return "", 0, false
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return "", 0, false
+	}
+	return digest, size, true
+}
 
-	// write file to disk
-	err = ioutil.WriteFile(filepath, filecontents, 0644)
+// The longest name a file may have
+const maxFilenameLength = 50
+
+// Return true if the given name is acceptable as the name of an uploaded file
+func validFilename(filename string) bool {
+	matched, _ := regexp.MatchString(fmt.Sprintf("^(?:[[:alnum:]]|[.]){1,%d}$", maxFilenameLength), filename)
+	// names made only of dots, like "..", have special meanings in paths
+	return matched && strings.Trim(filename, ".") != ""
+}
+
+// Held while looking up the name of a new file and recording it, so
+// concurrent uploads agree on which names are taken
+var recordFileLock sync.Mutex
+
+// Record a newly uploaded file in the files table, returning the name it
+// was stored under. If the owner already has a file with the same name in
+// the same folder, the upload becomes a new version of that file when
+// versioning is true, and is given a free name otherwise. The upload is
+// charged to the owner's quota, failing with errQuotaExceeded if it doesn't
+// fit. The file takes over the blob reference held by the caller, which is
+// released if recording fails.
+func addFile(owner, folderID, filename, digest string, size int64, versioning bool) (string, error) {
+	err := reserveQuota(owner, size)
 	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
+		releaseBlob(digest)
+		return "", err
 	}
+	filename, err = recordFile(owner, folderID, filename, digest, size, versioning)
+	if err != nil {
+		releaseQuota(owner, size)
+	}
+	return filename, err
+}
 
-	// update files database table
-	_, err = db.Exec("INSERT INTO files (owner, username, filename, filepath) VALUES (?, ?, ?, ?)", username, username, filename, filepath)
+// Record an upload whose size has already been charged to the owner
+func recordFile(owner, folderID, filename, digest string, size int64, versioning bool) (string, error) {
+	recordFileLock.Lock()
+	defer recordFileLock.Unlock()
+
+	var err error
+	if !versioning {
+		filename, err = uniqueFilename(db, owner, folderID, filename)
+		if err != nil {
+			releaseBlob(digest)
+			return "", err
+		}
+	}
+
+	row := db.QueryRow("SELECT object_id FROM files WHERE owner = ? AND username = ? AND folder_id = ? AND filename = ?", owner, owner, folderID, filename)
+
+	var objectID string
+	err = row.Scan(&objectID)
+	if err == nil {
+		return filename, addVersion(objectID, owner, digest, size)
+	} else if err != sql.ErrNoRows {
+		releaseBlob(digest)
+		return "", err
+	}
+
+	// identify the file by a fresh object ID rather than the file name
+	objectID, err = newObjectID()
 	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
+		releaseBlob(digest)
+		return "", err
 	}
-	http.Redirect(response, request, "/list", http.StatusFound)
 
-	//////////////////////////////////
-	// END TASK 3: YOUR CODE HERE
-	//////////////////////////////////
+	now := time.Now().Unix()
+	_, err = db.Exec("INSERT INTO files (owner, username, filename, object_id, digest, folder_id, size, content_type, uploaded, modified, role, pending) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0)",
+		owner, owner, filename, objectID, digest, folderID, size, detectContentType(filename, digest), now, now, roleOwner)
+	if err != nil {
+		releaseBlob(digest)
+		return "", err
+	}
+
+	// the first version holds a reference of its own
+	err = retainBlob(digest)
+	if err != nil {
+		return "", err
+	}
+	return filename, recordVersion(objectID, owner, digest, size)
+}
+
+// Return the part of a multipart upload request holding the "file" field,
+// along with the values of the form fields sent before it.
+// The part is read directly from the request body as the caller consumes it.
+func nextFilePart(request *http.Request) (*multipart.Part, map[string]string, error) {
+	reader, err := request.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, nil, errors.New("no file uploaded")
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if part.FormName() == "file" {
+			return part, fields, nil
+		}
+
+		// other fields are small, anything longer than this isn't legitimate
+		const maxFieldSize = 1024
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxFieldSize))
+		part.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		fields[part.FormName()] = string(value)
+	}
 }
 
 // fileInfo helps you pass information to the template
 type fileInfo struct {
-	Filename  string
-	FileOwner string
-	FilePath  string
+	Filename    string
+	FileOwner   string
+	ObjectID    string
+	Size        int64
+	ContentType string
+	Uploaded    time.Time
+	Modified    time.Time
+	Checksum    string // hex encoded SHA-256 of the contents
+	Role        string // what the user viewing the file may do with it
+}
+
+// Columns of the files table read by scanFileInfo
+const fileInfoColumns = "owner, filename, object_id, size, content_type, uploaded, modified, digest, role"
+
+// Read a fileInfo from a row selecting fileInfoColumns
+func scanFileInfo(row interface{ Scan(...interface{}) error }) (file fileInfo, err error) {
+	var uploaded, modified int64
+	err = row.Scan(&file.FileOwner, &file.Filename, &file.ObjectID, &file.Size, &file.ContentType, &uploaded, &modified, &file.Checksum, &file.Role)
+	file.Uploaded = time.Unix(uploaded, 0)
+	file.Modified = time.Unix(modified, 0)
+	return
+}
+
+// Return true if the user viewing the file may upload new versions of it
+func (file fileInfo) CanEdit() bool {
+	return roleAtLeast(file.Role, roleEditor)
+}
+
+// Return true if the user viewing the file may share it
+func (file fileInfo) CanShare() bool {
+	return roleAtLeast(file.Role, roleCoOwner)
+}
+
+// Return the file's size for people to read
+func (file fileInfo) HumanSize() string {
+	return formatBytes(file.Size)
+}
+
+// Columns the file list can be sorted by, as accepted in the sort parameter
+var fileSortColumns = map[string]string{
+	"name":     "filename",
+	"owner":    "owner",
+	"size":     "size",
+	"type":     "content_type",
+	"uploaded": "uploaded",
+	"modified": "modified",
 }
 
 func listFiles(response http.ResponseWriter, request *http.Request, username string) {
 	files := make([]fileInfo, 0)
 
+	// the folder to show, or the top level if empty
+	folderID := request.URL.Query().Get("folder")
+	var breadcrumbs []folderInfo
+	if folderID != "" {
+		var err error
+		breadcrumbs, err = visibleFolderPath(username, folderID)
+		if err != nil && err != sql.ErrNoRows {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		if len(breadcrumbs) == 0 {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, "not authorized to view folder")
+			return
+		}
+	}
+
+	folders, err := listSubfolders(username, folderID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	ownFolders, err := listOwnFolders(username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
 	//////////////////////////////////
 	// BEGIN TASK 4: YOUR CODE HERE
 	//////////////////////////////////
 
+	// sort by name unless asked otherwise
+	sort := request.URL.Query().Get("sort")
+	sortColumn, ok := fileSortColumns[sort]
+	if !ok {
+		sort, sortColumn = "name", "filename"
+	}
+	order := "asc"
+	if request.URL.Query().Get("order") == "desc" {
+		order = "desc"
+	}
+	orderBy := " ORDER BY " + sortColumn + " " + order + ", filename"
+
 	// for each of the user's files, add a
 	// corresponding fileInfo struct to the files slice.
-	rows, err := db.Query("SELECT owner, filename, filepath FROM files WHERE username =?", username)
+	// files shared with the user individually or with one of their groups
+	// are shown at the top level.
+	var rows *sql.Rows
+	if folderID == "" {
+		rows, err = db.Query("SELECT "+fileInfoColumns+" FROM files WHERE username = ? AND pending = 0 AND (owner != username OR folder_id = '')"+
+			" UNION SELECT "+fileInfoColumns+" FROM files WHERE username = owner AND owner != ?"+
+			" AND object_id IN (SELECT file_group_shares.object_id FROM file_group_shares"+
+			" JOIN group_members ON group_members.group_id = file_group_shares.group_id WHERE group_members.username = ? AND group_members.pending = 0)"+
+			" AND object_id NOT IN (SELECT object_id FROM files WHERE username = ? AND pending = 0)"+orderBy, username, username, username, username)
+	} else {
+		rows, err = db.Query("SELECT "+fileInfoColumns+" FROM files WHERE folder_id = ? AND username = owner"+orderBy, folderID)
+	}
 
 	if err != nil {
-		log.Fatal(err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
 	}
+	defer rows.Close()
 
-	var (
-		owner, filename, filepath string
-	)
+	// inside someone else's folder, the user's role comes from the folder share
+	role := ""
+	if folderID != "" {
+		role, err = folderRole(username, folderID)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+	}
 
+	// at the top level, files of other users were shared with this one
+	sharedWithMe := make([]fileInfo, 0)
 	for rows.Next() {
-		err = rows.Scan(&owner, &filename, &filepath)
+		file, err := scanFileInfo(rows)
 
 		if err != nil {
-			log.Fatal(err)
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		if role != "" {
+			file.Role = role
+		}
+		if folderID == "" && file.FileOwner != username {
+			sharedWithMe = append(sharedWithMe, file)
+		} else {
+			files = append(files, file)
+		}
+	}
+	rows.Close()
+
+	// the user may have a stronger role through their groups or folders
+	for i := range sharedWithMe {
+		sharedWithMe[i].Role, err = fileRole(username, sharedWithMe[i].ObjectID)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
 		}
-		file := fileInfo{Filename: filename, FileOwner: owner, FilePath: filepath}
-		files = append(files, file)
 	}
 
 	//////////////////////////////////
 	// END TASK 4: YOUR CODE HERE
 	//////////////////////////////////
 
+	// only the owner of a folder may change what is inside it
+	var currentFolder folderInfo
+	if len(breadcrumbs) > 0 {
+		currentFolder = breadcrumbs[len(breadcrumbs)-1]
+	}
+	canModify := folderID == "" || currentFolder.Owner == username
+
+	// likewise split folders, and list what the user shared with others
+	var sharedFolders []folderInfo
+	var sharedByMe []shareInfo
+	if folderID == "" {
+		ownRootFolders := make([]folderInfo, 0)
+		for _, folder := range folders {
+			if folder.Owner == username {
+				ownRootFolders = append(ownRootFolders, folder)
+				continue
+			}
+			folder.Role, err = folderRole(username, folder.ID)
+			if err != nil {
+				response.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(response, err.Error())
+				return
+			}
+			sharedFolders = append(sharedFolders, folder)
+		}
+		folders = ownRootFolders
+
+		sharedByMe, err = listSharedByMe(username)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+	}
+
+	used, err := quotaUsed(username)
+	if err != nil {
+		log.Error(err)
+	}
+
+	notifications, err := listNotifications(username)
+	if err != nil {
+		log.Error(err)
+	}
+
+	// links for the column headers, reversing the order of the current sort column
+	sortURLs := make(map[string]string)
+	for key := range fileSortColumns {
+		query := url.Values{}
+		if folderID != "" {
+			query.Set("folder", folderID)
+		}
+		query.Set("sort", key)
+		if key == sort && order == "asc" {
+			query.Set("order", "desc")
+		}
+		sortURLs[key] = "/list?" + query.Encode()
+	}
+
 	data := map[string]interface{}{
-		"Username": username,
-		"Files":    files,
+		"SortURLs":      sortURLs,
+		"QuotaUsed":     formatBytes(used),
+		"Quota":         formatBytes(userQuota(username)),
+		"Username":      username,
+		"Files":         files,
+		"Folders":       folders,
+		"SharedWithMe":  sharedWithMe,
+		"SharedFolders": sharedFolders,
+		"SharedByMe":    sharedByMe,
+		"OwnFolders":    ownFolders,
+		"Breadcrumbs":   breadcrumbs,
+		"FolderID":      folderID,
+		"CanModify":     canModify,
+		"Notifications": notifications,
 	}
 
 	tmpl, err := template.ParseFiles("templates/base.html", "templates/list.html")
@@ -235,6 +626,52 @@ func listFiles(response http.ResponseWriter, request *http.Request, username str
 	}
 }
 
+// Show the upload form, uploading into the folder given in the query string,
+// or uploading a new version of the file given as replace
+func showUploadPage(response http.ResponseWriter, request *http.Request, username string) {
+	folderID := request.URL.Query().Get("folder")
+	replaceID := request.URL.Query().Get("replace")
+
+	var replace fileInfo
+	if replaceID != "" {
+		_, err := checkEditor(username, replaceID)
+		if err == nil {
+			replace, err = scanFileInfo(db.QueryRow("SELECT "+fileInfoColumns+" FROM files WHERE object_id = ? AND username = owner", replaceID))
+		}
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+	}
+
+	var folder folderInfo
+	if folderID != "" {
+		var err error
+		folder, err = lookupFolder(folderID)
+		if err != nil || folder.Owner != username {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, "no such folder")
+			return
+		}
+	}
+
+	data := map[string]interface{}{
+		"Username": username,
+		"Folder":   folder,
+		"Replace":  replace,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/upload.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
 func getFile(response http.ResponseWriter, request *http.Request, username string) {
 	fileString := strings.TrimPrefix(request.URL.Path, "/file/")
 
@@ -244,43 +681,84 @@ func getFile(response http.ResponseWriter, request *http.Request, username strin
 	// BEGIN TASK 5: YOUR CODE HERE
 	//////////////////////////////////
 	// check to see if user is allowed to download
-	rows, err := db.Query("SELECT filepath, filename FROM files WHERE username =?", username)
-
-	if err != nil {
-		log.Fatal(err)
+	file, err := lookupDownload(username, fileString)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to download")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
 	}
-	defer rows.Close()
 
-	var filepath string
-	var filename string
-	authorized := false
+	// Download file
+	serveFile(response, request, file)
 
-	for rows.Next() {
-		err = rows.Scan(&filepath, &filename)
+	//////////////////////////////////
+	// END TASK 5: YOUR CODE HERE
+	//////////////////////////////////
+}
 
-		if err != nil {
-			log.Fatal(err)
-		}
+// Look up a file the given user may download: one of their own, one shared
+// with them, or one inside a folder or shared with a group they have access
+// to. Returns sql.ErrNoRows if they may not download it.
+func lookupDownload(username, objectID string) (fileInfo, error) {
+	row := db.QueryRow("SELECT "+fileInfoColumns+" FROM files WHERE username = ? AND object_id = ? AND pending = 0", username, objectID)
 
-		if filepath == fileString {
-			authorized = true
-			break
-		}
+	file, err := scanFileInfo(row)
+	if err == sql.ErrNoRows {
+		// the file may also be inside a folder shared with the user
+		file, err = lookupFolderFile(username, objectID)
 	}
+	if err == sql.ErrNoRows {
+		// or shared with one of the user's groups
+		file, err = lookupGroupFile(username, objectID)
+	}
+	return file, err
+}
 
-	// Download file
-	if authorized {
-		setNameOfServedFile(response, filename)
-		http.ServeFile(response, request, fileString)
-	} else {
-		response.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(response, "not authorized to download")
+// Send the current contents of a file as a download. Range requests let
+// interrupted downloads resume, and conditional requests let clients reuse
+// a copy they already have.
+func serveFile(response http.ResponseWriter, request *http.Request, file fileInfo) {
+	blob, err := os.Open(blobPath(file.Checksum))
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
 		return
 	}
+	defer blob.Close()
 
-	//////////////////////////////////
-	// END TASK 5: YOUR CODE HERE
-	//////////////////////////////////
+	setNameOfServedFile(response, file.Filename)
+	response.Header().Set("Content-Type", file.ContentType)
+	response.Header().Set("ETag", fileETag(file))
+	http.ServeContent(response, request, file.Filename, file.Modified, blob)
+}
+
+// Return the ETag of a file's current contents. Blobs are named after the
+// hash of their contents, so it is a strong validator.
+func fileETag(file fileInfo) string {
+	return `"` + file.Checksum + `"`
+}
+
+// Return true if a GET request for a file will be answered with 304 Not
+// Modified, following the same rules as http.ServeContent
+func notModified(request *http.Request, file fileInfo) bool {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		return false
+	}
+	if header := request.Header.Get("If-None-Match"); header != "" {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == fileETag(file) {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	return err == nil && !file.Modified.Truncate(time.Second).After(since)
 }
 
 func setNameOfServedFile(response http.ResponseWriter, fileName string) {
@@ -290,7 +768,20 @@ func setNameOfServedFile(response http.ResponseWriter, fileName string) {
 func processShare(response http.ResponseWriter, request *http.Request, sender string) {
 	recipient := request.FormValue("username")
 	filename := request.FormValue("filename")
-	_ = filename
+
+	// the file may be given by ID, or by the name of one of the sender's files
+	objectID := request.FormValue("file")
+
+	// recipients are viewers unless the sender asks for more
+	role := request.FormValue("role")
+	if role == "" {
+		role = roleViewer
+	}
+	if !validShareRole(role) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "invalid role")
+		return
+	}
 
 	if sender == recipient {
 		response.WriteHeader(http.StatusBadRequest)
@@ -302,44 +793,84 @@ func processShare(response http.ResponseWriter, request *http.Request, sender st
 	// BEGIN TASK 6: YOUR CODE HERE
 	//////////////////////////////////
 
-	// check to see if the sender is allowed to send
-	rows, err := db.Query("SELECT filename, filepath FROM files WHERE owner =?", sender)
-
-	if err != nil {
-		log.Fatal(err)
+	if objectID == "" {
+		row := db.QueryRow("SELECT object_id FROM files WHERE username = ? AND filename = ? AND pending = 0", sender, filename)
+		err := row.Scan(&objectID)
+		if err != nil && err != sql.ErrNoRows {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
 	}
 
-	var (
-		file, filepath string
-	)
-	authorized := false
+	// check to see if the sender is allowed to send:
+	// owners and co-owners may share
+	authorized := checkFileSharer(response, sender, objectID)
+	if !authorized {
+		return
+	}
 
-	for rows.Next() {
-		err = rows.Scan(&file, &filepath)
+	// a group share covers everyone who is or will be a member
+	if groupName := request.FormValue("group"); groupName != "" {
+		shareFileWithGroup(response, sender, objectID, groupName, role)
+		return
+	}
 
+	// sharing the same file again only changes the recipient's role
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM files WHERE object_id = ? AND username = ?", objectID, recipient).Scan(&count)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if count > 0 {
+		_, err = db.Exec("UPDATE files SET role = ? WHERE object_id = ? AND username = ? AND username != owner", role, objectID, recipient)
 		if err != nil {
-			log.Fatal(err)
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
 		}
+		fmt.Fprintf(response, "file shared")
+		return
+	}
 
-		if file == filename {
-			authorized = true
-		}
+	// the share waits in the recipient's inbox unless they accept shares
+	// from the sender automatically
+	pending, err := sharePending(recipient, sender)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
 	}
 
 	// update files database table
-	if authorized {
-		_, err := db.Exec("INSERT INTO files (owner, username, filename, filepath) VALUES (?, ?, ?, ?)", sender, recipient, filename, filepath)
+	// the recipient's row is another reference to the same blob
+	var digest, name string
+	err = db.QueryRow("SELECT digest, filename FROM files WHERE object_id = ? AND username = owner", objectID).Scan(&digest, &name)
+	if err == nil {
+		err = retainBlob(digest)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	_, err = db.Exec(`INSERT INTO files (owner, username, filename, object_id, digest, folder_id, size, content_type, uploaded, modified, role, pending)
+		SELECT owner, ?, filename, object_id, digest, folder_id, size, content_type, uploaded, modified, ?, ? FROM files WHERE object_id = ? AND username = owner`, recipient, role, pending, objectID)
+	if err != nil {
+		releaseBlob(digest)
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if pending {
+		err = notifyInvitation(recipient, sender, name)
 		if err != nil {
-			fmt.Fprintf(response, err.Error())
-			response.WriteHeader(http.StatusInternalServerError)
-			return
+			log.Error(err)
 		}
-		fmt.Fprintf(response, "file shared")
-	} else {
-		response.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(response, "not authorized to share file")
-		return
 	}
+	fmt.Fprintf(response, "file shared")
 
 	//////////////////////////////////
 	// END TASK 6: YOUR CODE HERE
@@ -371,6 +902,7 @@ func initSession(response http.ResponseWriter, username string) {
 	http.SetCookie(response, &http.Cookie{
 		Name:     "session_token",
 		Value:    sessionToken,
+		Path:     "/",
 		Expires:  expires,
 		SameSite: http.SameSiteStrictMode,
 	})
@@ -11,6 +11,13 @@ import (
 
 var db *sql.DB
 
+// dbQuerier runs statements, either on the database or in a transaction
+type dbQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 func initDB() {
 	var err error
 	db, err = sql.Open("sqlite3", "test.db")
@@ -40,7 +47,167 @@ func createTables() {
 							owner TEXT,
 							username TEXT,
 							filename TEXT,
-							filepath TEXT
+							object_id TEXT,
+							digest TEXT,
+							folder_id TEXT,
+							size INTEGER,
+							content_type TEXT,
+							uploaded INTEGER,
+							modified INTEGER,
+							role TEXT,
+							pending INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS folders (id TEXT NOT NULL PRIMARY KEY,
+							owner TEXT,
+							name TEXT,
+							parent_id TEXT
+							);
+		CREATE TABLE IF NOT EXISTS folder_shares (id INTEGER NOT NULL PRIMARY KEY,
+							folder_id TEXT,
+							owner TEXT,
+							username TEXT,
+							role TEXT,
+							pending INTEGER,
+							UNIQUE (folder_id, username)
+							);
+		CREATE TABLE IF NOT EXISTS trash (id INTEGER NOT NULL PRIMARY KEY,
+							owner TEXT,
+							username TEXT,
+							filename TEXT,
+							object_id TEXT,
+							digest TEXT,
+							folder_id TEXT,
+							size INTEGER,
+							content_type TEXT,
+							uploaded INTEGER,
+							modified INTEGER,
+							role TEXT,
+							pending INTEGER,
+							deleted INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS blobs (digest TEXT NOT NULL PRIMARY KEY,
+							size INTEGER,
+							refcount INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS versions (id INTEGER NOT NULL PRIMARY KEY,
+							object_id TEXT,
+							number INTEGER,
+							digest TEXT,
+							size INTEGER,
+							uploader TEXT,
+							created INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS storage_usage (username TEXT NOT NULL PRIMARY KEY,
+							bytes INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS uploads (id TEXT NOT NULL PRIMARY KEY,
+							username TEXT,
+							folder_id TEXT,
+							replace_id TEXT,
+							filename TEXT,
+							length INTEGER,
+							upload_offset INTEGER,
+							expires INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS share_links (token TEXT NOT NULL PRIMARY KEY,
+							object_id TEXT,
+							username TEXT,
+							created INTEGER,
+							expires INTEGER,
+							max_downloads INTEGER,
+							downloads INTEGER,
+							password TEXT,
+							salt TEXT
+							);
+		CREATE TABLE IF NOT EXISTS file_requests (token TEXT NOT NULL PRIMARY KEY,
+							username TEXT,
+							folder_id TEXT,
+							created INTEGER,
+							expires INTEGER,
+							max_size INTEGER,
+							file_types TEXT,
+							uploads INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS user_groups (id TEXT NOT NULL PRIMARY KEY,
+							name TEXT UNIQUE,
+							owner TEXT
+							);
+		CREATE TABLE IF NOT EXISTS group_members (id INTEGER NOT NULL PRIMARY KEY,
+							group_id TEXT,
+							username TEXT,
+							pending INTEGER,
+							UNIQUE (group_id, username)
+							);
+		CREATE TABLE IF NOT EXISTS file_group_shares (id INTEGER NOT NULL PRIMARY KEY,
+							object_id TEXT,
+							owner TEXT,
+							group_id TEXT,
+							role TEXT,
+							UNIQUE (object_id, group_id)
+							);
+		CREATE TABLE IF NOT EXISTS folder_group_shares (id INTEGER NOT NULL PRIMARY KEY,
+							folder_id TEXT,
+							owner TEXT,
+							group_id TEXT,
+							role TEXT,
+							UNIQUE (folder_id, group_id)
+							);
+		CREATE TABLE IF NOT EXISTS transfers (id INTEGER NOT NULL PRIMARY KEY,
+							kind TEXT,
+							name TEXT,
+							from_user TEXT,
+							to_user TEXT,
+							by_user TEXT,
+							occurred INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS transfer_offers (id INTEGER NOT NULL PRIMARY KEY,
+							kind TEXT,
+							item_id TEXT,
+							name TEXT,
+							from_user TEXT,
+							to_user TEXT,
+							created INTEGER,
+							UNIQUE (kind, item_id, to_user)
+							);
+		CREATE TABLE IF NOT EXISTS auto_accept (id INTEGER NOT NULL PRIMARY KEY,
+							username TEXT,
+							sender TEXT,
+							group_id TEXT,
+							UNIQUE (username, sender, group_id)
+							);
+		CREATE TABLE IF NOT EXISTS totp (username TEXT NOT NULL PRIMARY KEY,
+							secret TEXT,
+							enabled INTEGER,
+							last_step INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS recovery_codes (id INTEGER NOT NULL PRIMARY KEY,
+							username TEXT,
+							code TEXT
+							);
+		CREATE TABLE IF NOT EXISTS login_challenges (token TEXT NOT NULL PRIMARY KEY,
+							username TEXT,
+							expires INTEGER,
+							attempts INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS login_throttle (kind TEXT NOT NULL,
+							name TEXT NOT NULL,
+							failures INTEGER,
+							last_attempt INTEGER,
+							blocked_until INTEGER,
+							PRIMARY KEY (kind, name)
+							);
+		CREATE TABLE IF NOT EXISTS emails (username TEXT NOT NULL PRIMARY KEY,
+							address TEXT
+							);
+		CREATE TABLE IF NOT EXISTS password_resets (token TEXT NOT NULL PRIMARY KEY,
+							username TEXT,
+							created INTEGER,
+							expires INTEGER
+							);
+		CREATE TABLE IF NOT EXISTS notifications (id INTEGER NOT NULL PRIMARY KEY,
+							username TEXT,
+							message TEXT,
+							created INTEGER
 							);`
 	// TODO: modify the schema of the files table to help implement tasks 3-6.
 	// do NOT modify the schema of the sessions or users tables.
@@ -63,7 +230,7 @@ func createTables() {
 // Remove all tables from the database
 func dropTables() {
 	log.Printf("dropping all tables")
-	tables := []string{"users", "sessions", "files"}
+	tables := []string{"users", "sessions", "files", "blobs", "versions", "uploads", "folders", "folder_shares", "trash", "storage_usage", "share_links", "file_requests", "notifications", "user_groups", "group_members", "file_group_shares", "folder_group_shares", "transfers", "transfer_offers", "auto_accept", "totp", "recovery_codes", "login_challenges", "login_throttle", "emails", "password_resets"}
 	for _, table := range tables {
 		_, err := db.Exec("DROP TABLE " + table)
 		if err != nil {
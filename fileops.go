@@ -0,0 +1,166 @@
+// Operations on existing files: delete, rename, move, revoking shares,
+// signing download URLs and transferring ownership.
+// Only the owner of a file may change it, though co-owners may revoke its
+// shares. Every change applies to the owner's row in the files table as well
+// as all shared copies.
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Entry point for POST requests to /file/{id}/{action}
+func handleFileAction(response http.ResponseWriter, request *http.Request, username, objectID, action string) {
+	switch action {
+	case "delete":
+		deleteFile(response, request, username, objectID)
+	case "rename":
+		renameFile(response, request, username, objectID)
+	case "move":
+		moveFile(response, request, username, objectID)
+	case "revoke":
+		revokeFileShare(response, request, username, objectID)
+	case "sign":
+		signFile(response, request, username, objectID)
+	case "transfer":
+		transferFileOwnership(response, request, username, objectID)
+
+	default:
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "not found")
+	}
+}
+
+// Return the folder a file is in
+func fileFolder(objectID string) (folderID string, err error) {
+	row := db.QueryRow("SELECT folder_id FROM files WHERE object_id = ? AND username = owner", objectID)
+	err = row.Scan(&folderID)
+	return
+}
+
+// Check that the owner has no other file of the given name in a folder,
+// since uploading that name again must resolve to a single file
+func checkFilenameFree(owner, folderID, filename, exceptID string) error {
+	var count int
+	row := db.QueryRow("SELECT COUNT(*) FROM files WHERE owner = ? AND username = owner AND folder_id = ? AND filename = ? AND object_id != ?", owner, folderID, filename, exceptID)
+	err := row.Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("a file named %s already exists there", filename)
+	}
+	return nil
+}
+
+// Return the digests referenced by a query's result rows
+func queryDigests(q dbQuerier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var digests []string
+	for rows.Next() {
+		var digest string
+		err = rows.Scan(&digest)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+	return digests, rows.Err()
+}
+
+// Delete a file by moving it to the trash. Requested either with
+// DELETE /file/{id}, or with POST /file/{id}/delete from the file list.
+func deleteFile(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	_, ok := checkFileOwner(response, username, objectID)
+	if !ok {
+		return
+	}
+
+	folderID, err := fileFolder(objectID)
+	if err == nil {
+		err = trashFile(objectID)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	if request.Method == "DELETE" {
+		fmt.Fprintf(response, "file moved to trash")
+		return
+	}
+	redirectToFolder(response, request, folderID)
+}
+
+func renameFile(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	filename := request.FormValue("filename")
+
+	_, ok := checkFileOwner(response, username, objectID)
+	if !ok {
+		return
+	}
+	if !validFilename(filename) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "invalid file name")
+		return
+	}
+
+	folderID, err := fileFolder(objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	err = checkFilenameFree(username, folderID, filename, objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	_, err = db.Exec("UPDATE files SET filename = ? WHERE object_id = ?", filename, objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	redirectToFolder(response, request, folderID)
+}
+
+func moveFile(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	folderID := request.FormValue("folder")
+
+	filename, ok := checkFileOwner(response, username, objectID)
+	if !ok {
+		return
+	}
+	err := checkFolderOwner(username, folderID)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	err = checkFilenameFree(username, folderID, filename, objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	_, err = db.Exec("UPDATE files SET folder_id = ? WHERE object_id = ?", folderID, objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	redirectToFolder(response, request, folderID)
+}
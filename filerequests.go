@@ -0,0 +1,409 @@
+// File requests: upload-only links for collecting files from people
+// without an account.
+//
+// A file request is bound to a token, the user who created it and one of
+// their folders. Anyone with the link can upload files through /r/{token},
+// which land in that folder as if the owner had uploaded them, but can't
+// see or change anything else. Requests may expire and limit the size and
+// type of the files uploaded. The owner is notified of every upload.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Size of file request tokens; long enough that they can't be guessed
+const fileRequestTokenSizeBytes = 32
+
+// fileRequestInfo helps you pass information about a file request to the template
+type fileRequestInfo struct {
+	Token     string
+	Owner     string
+	FolderID  string
+	Folder    string
+	Created   time.Time
+	Expires   time.Time // zero if the request never expires
+	MaxSize   int64     // zero if any size within the owner's quota is accepted
+	FileTypes string    // comma-separated extensions and MIME types, empty if any are accepted
+	Uploads   int64
+}
+
+// Return the maximum size for people to read
+func (fileRequest fileRequestInfo) HumanMaxSize() string {
+	return formatBytes(fileRequest.MaxSize)
+}
+
+// Look up a file request
+func lookupFileRequest(token string) (fileRequest fileRequestInfo, err error) {
+	var created, expires int64
+	row := db.QueryRow("SELECT token, username, folder_id, created, expires, max_size, file_types, uploads FROM file_requests WHERE token = ?", token)
+	err = row.Scan(&fileRequest.Token, &fileRequest.Owner, &fileRequest.FolderID, &created, &expires, &fileRequest.MaxSize, &fileRequest.FileTypes, &fileRequest.Uploads)
+	if err != nil {
+		return
+	}
+	fileRequest.Created = time.Unix(created, 0)
+	if expires != 0 {
+		fileRequest.Expires = time.Unix(expires, 0)
+	}
+	fileRequest.Folder = folderName(fileRequest.FolderID)
+	return
+}
+
+// Return the name of a folder for display, or "" for the top level
+func folderName(folderID string) string {
+	if folderID == "" {
+		return ""
+	}
+	folder, err := lookupFolder(folderID)
+	if err != nil {
+		return "(deleted folder)"
+	}
+	return folder.Name
+}
+
+// Return true if a file matches one of the comma-separated types, which
+// are either extensions like .pdf or MIME types like image/png or image/*
+func matchesFileTypes(fileTypes, filename, contentType string) bool {
+	if fileTypes == "" {
+		return true
+	}
+	extension := strings.ToLower(filepath.Ext(filename))
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	for _, fileType := range strings.Split(fileTypes, ",") {
+		fileType = strings.ToLower(strings.TrimSpace(fileType))
+		switch {
+		case strings.HasPrefix(fileType, "."):
+			if fileType == extension {
+				return true
+			}
+		case strings.HasSuffix(fileType, "/*"):
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(fileType, "*")) {
+				return true
+			}
+		case fileType == mediaType:
+			return true
+		}
+	}
+	return false
+}
+
+// Return a name for an uploaded file that none of the owner's files in the
+// folder has yet, so uploads through a file request never replace a file.
+// Names are shortened where needed to make room for the number added.
+func uniqueFilename(q dbQuerier, owner, folderID, filename string) (string, error) {
+	extension := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, extension)
+	candidate := filename
+	for i := 2; ; i++ {
+		if !validFilename(candidate) {
+			return "", fmt.Errorf("no free name for %s", filename)
+		}
+		var count int
+		row := q.QueryRow("SELECT COUNT(*) FROM files WHERE owner = ? AND username = owner AND folder_id = ? AND filename = ?", owner, folderID, candidate)
+		err := row.Scan(&count)
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		suffix := strconv.Itoa(i)
+		name, ext := base, extension
+		// keep the extension unless it leaves no room for the name
+		if len(ext)+len(suffix) >= maxFilenameLength {
+			name, ext = filename, ""
+		}
+		if room := maxFilenameLength - len(suffix) - len(ext); len(name) > room {
+			name = name[:room]
+		}
+		candidate = name + suffix + ext
+	}
+}
+
+// Entry point for requests to /requests and /requests/{token}/revoke
+func handleFileRequestRequest(response http.ResponseWriter, request *http.Request, username string) {
+	path := strings.Split(strings.TrimPrefix(request.URL.Path, "/requests"), "/")
+
+	switch {
+	case len(path) == 1 && request.Method == "GET":
+		listFileRequests(response, request, username)
+	case len(path) == 1 && request.Method == "POST":
+		createFileRequest(response, request, username)
+	case len(path) == 3 && path[2] == "revoke" && request.Method == "POST":
+		revokeFileRequest(response, request, username, path[1])
+
+	default:
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "not found")
+	}
+}
+
+// Show the user's file requests, along with a form for creating new ones
+func listFileRequests(response http.ResponseWriter, request *http.Request, username string) {
+	rows, err := db.Query("SELECT token FROM file_requests WHERE username = ? ORDER BY created DESC", username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	var tokens []string
+	for rows.Next() {
+		var token string
+		err = rows.Scan(&token)
+		if err != nil {
+			rows.Close()
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+
+	fileRequests := make([]fileRequestInfo, 0)
+	for _, token := range tokens {
+		fileRequest, err := lookupFileRequest(token)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		fileRequests = append(fileRequests, fileRequest)
+	}
+
+	folders, err := listOwnFolders(username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Username": username,
+		"Requests": fileRequests,
+		"Folders":  folders,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/requests.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Create a file request for one of the user's folders. The expiry, size
+// limit (in megabytes) and accepted file types are all optional.
+func createFileRequest(response http.ResponseWriter, request *http.Request, username string) {
+	folderID := request.FormValue("folder")
+	fileTypes := strings.TrimSpace(request.FormValue("file_types"))
+
+	err := checkFolderOwner(username, folderID)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	var expires int64
+	if value := request.FormValue("expires"); value != "" {
+		expiry, err := time.ParseInLocation("2006-01-02T15:04", value, time.Local)
+		if err != nil || expiry.Before(time.Now()) {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, "invalid expiry date")
+			return
+		}
+		expires = expiry.Unix()
+	}
+
+	var maxSize int64
+	if value := request.FormValue("max_size"); value != "" {
+		megabytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || megabytes <= 0 || megabytes > maxUploadSize>>20 {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(response, "size limit must be between 1 and %d MB", maxUploadSize>>20)
+			return
+		}
+		maxSize = megabytes << 20
+	}
+
+	token, err := randomByteString(fileRequestTokenSizeBytes)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	_, err = db.Exec("INSERT INTO file_requests VALUES (?, ?, ?, ?, ?, ?, ?, 0)",
+		token, username, folderID, time.Now().Unix(), expires, maxSize, fileTypes)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/requests", http.StatusFound)
+}
+
+// Delete one of the user's file requests
+func revokeFileRequest(response http.ResponseWriter, request *http.Request, username, token string) {
+	result, err := db.Exec("DELETE FROM file_requests WHERE token = ? AND username = ?", token, username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "no such file request")
+		return
+	}
+
+	http.Redirect(response, request, "/requests", http.StatusFound)
+}
+
+// Look up the file request for a request to /r/{token}.
+// Writes an error response and returns false if it doesn't exist or has expired.
+func checkFileRequest(response http.ResponseWriter, request *http.Request) (fileRequest fileRequestInfo, ok bool) {
+	token := strings.TrimPrefix(request.URL.Path, "/r/")
+
+	fileRequest, err := lookupFileRequest(token)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "no such file request")
+		return fileRequest, false
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return fileRequest, false
+	}
+	if !fileRequest.Expires.IsZero() && !fileRequest.Expires.After(time.Now()) {
+		response.WriteHeader(http.StatusGone)
+		fmt.Fprint(response, "file request has expired")
+		return fileRequest, false
+	}
+	return fileRequest, true
+}
+
+// Handle GET /r/{token}: show the anonymous upload form
+func showFileRequestPage(response http.ResponseWriter, request *http.Request) {
+	fileRequest, ok := checkFileRequest(response, request)
+	if !ok {
+		return
+	}
+	renderFileRequestPage(response, fileRequest, "")
+}
+
+// Render the anonymous upload form, with a message about the last upload
+func renderFileRequestPage(response http.ResponseWriter, fileRequest fileRequestInfo, message string) {
+	data := map[string]interface{}{
+		"Request": fileRequest,
+		"Message": message,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/request.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Handle POST /r/{token}: upload a file into the request's folder,
+// charged to the owner, and let the owner know
+func processFileRequestUpload(response http.ResponseWriter, request *http.Request) {
+	fileRequest, ok := checkFileRequest(response, request)
+	if !ok {
+		return
+	}
+
+	request.Body = http.MaxBytesReader(response, request.Body, maxUploadSize)
+	file, fields, err := nextFilePart(request)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	defer file.Close()
+
+	filename := file.FileName()
+	if !validFilename(filename) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "invalid file name")
+		return
+	}
+
+	// read one byte past the size limit to tell whether the file is over it
+	var reader io.Reader = file
+	if fileRequest.MaxSize > 0 {
+		reader = io.LimitReader(file, fileRequest.MaxSize+1)
+	}
+	digest, size, ok := storeUpload(response, reader, fileRequest.Owner)
+	if !ok {
+		return
+	}
+	if fileRequest.MaxSize > 0 && size > fileRequest.MaxSize {
+		releaseBlob(digest)
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(response, "file exceeds the maximum size of %s", fileRequest.HumanMaxSize())
+		return
+	}
+	// the type is checked once the contents are there to look at
+	if !matchesFileTypes(fileRequest.FileTypes, filename, detectContentType(filename, digest)) {
+		releaseBlob(digest)
+		response.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(response, "only these file types are accepted: %s", fileRequest.FileTypes)
+		return
+	}
+
+	// the folder may have been deleted since the request was created
+	folderID := fileRequest.FolderID
+	if checkFolderOwner(fileRequest.Owner, folderID) != nil {
+		folderID = ""
+	}
+	filename, err = addFile(fileRequest.Owner, folderID, filename, digest, size, false)
+	if err == errQuotaExceeded {
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprint(response, "the recipient has run out of storage space")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	_, err = db.Exec("UPDATE file_requests SET uploads = uploads + 1 WHERE token = ?", fileRequest.Token)
+	if err != nil {
+		log.Error(err)
+	}
+
+	// uploaders may say who they are, but can't be verified
+	uploader := strings.TrimSpace(fields["name"])
+	if uploader == "" {
+		uploader = "Someone"
+	}
+	destination := "your files"
+	if folderID != "" {
+		destination = folderName(folderID)
+	}
+	err = notify(fileRequest.Owner, fmt.Sprintf("%s uploaded %s to %s through a file request", uploader, filename, destination))
+	if err != nil {
+		log.Error(err)
+	}
+
+	renderFileRequestPage(response, fileRequest, fmt.Sprintf("Thank you, %s was uploaded.", file.FileName()))
+}
@@ -0,0 +1,497 @@
+// Folders for organizing files.
+//
+// Every folder belongs to one owner and has a parent folder, the empty ID
+// standing for the owner's top level. Files record the folder they are in.
+// Sharing a folder with someone gives them access to everything below it,
+// including files and folders added after it was shared.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// folderInfo helps you pass information about a folder to the template
+type folderInfo struct {
+	ID     string
+	Name   string
+	Owner  string
+	Parent string
+	Role   string // set when listing folders shared with the user
+}
+
+// Look up a single folder
+func lookupFolder(folderID string) (folder folderInfo, err error) {
+	row := db.QueryRow("SELECT id, name, owner, parent_id FROM folders WHERE id = ?", folderID)
+	err = row.Scan(&folder.ID, &folder.Name, &folder.Owner, &folder.Parent)
+	return
+}
+
+// Return the path leading to a folder, starting at the top level and ending
+// with the folder itself
+func folderAncestors(folderID string) ([]folderInfo, error) {
+	var path []folderInfo
+	for folderID != "" {
+		folder, err := lookupFolder(folderID)
+		if err != nil {
+			return nil, err
+		}
+		path = append([]folderInfo{folder}, path...)
+		folderID = folder.Parent
+
+		// guard against a corrupted hierarchy looping forever
+		if len(path) > 1000 {
+			return nil, errors.New("folder hierarchy is too deep")
+		}
+	}
+	return path, nil
+}
+
+// Return how many levels of folders there are in the tree starting at a
+// folder, counting the folder itself
+func folderHeight(folderID string) (int, error) {
+	height := 0
+	level := []string{folderID}
+	for len(level) > 0 {
+		height++
+		var next []string
+		for _, id := range level {
+			children, err := queryObjectIDs(db, "SELECT id FROM folders WHERE parent_id = ?", id)
+			if err != nil {
+				return 0, err
+			}
+			next = append(next, children...)
+		}
+		level = next
+	}
+	return height, nil
+}
+
+// Return the part of a folder's path that the given user may see: the whole
+// path for the owner, or the path starting at the outermost folder shared
+// with them or one of their groups. Returns an empty path if the user has no access to the folder.
+func visibleFolderPath(username, folderID string) ([]folderInfo, error) {
+	path, err := folderAncestors(folderID)
+	if err != nil || len(path) == 0 {
+		return nil, err
+	}
+	if path[0].Owner == username {
+		return path, nil
+	}
+	for i, folder := range path {
+		var count int
+		row := db.QueryRow(`SELECT (SELECT COUNT(*) FROM folder_shares WHERE folder_id = ? AND username = ? AND pending = 0)
+			+ (SELECT COUNT(*) FROM folder_group_shares JOIN group_members ON group_members.group_id = folder_group_shares.group_id
+				WHERE folder_group_shares.folder_id = ? AND group_members.username = ? AND group_members.pending = 0)`, folder.ID, username, folder.ID, username)
+		err = row.Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return path[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+// Return true if the given user may see the contents of a folder
+func canAccessFolder(username, folderID string) (bool, error) {
+	path, err := visibleFolderPath(username, folderID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return len(path) > 0, err
+}
+
+// Check that a folder ID names a folder owned by the given user, or is
+// empty for the user's top level
+func checkFolderOwner(username, folderID string) error {
+	if folderID == "" {
+		return nil
+	}
+	folder, err := lookupFolder(folderID)
+	if err == sql.ErrNoRows || (err == nil && folder.Owner != username) {
+		return errors.New("no such folder")
+	}
+	return err
+}
+
+// Check that no other folder in the same parent already uses the given name
+func checkFolderNameFree(owner, parentID, name, exceptID string) error {
+	var count int
+	row := db.QueryRow("SELECT COUNT(*) FROM folders WHERE owner = ? AND parent_id = ? AND name = ? AND id != ?", owner, parentID, name, exceptID)
+	err := row.Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("a folder named %s already exists there", name)
+	}
+	return nil
+}
+
+// Look up a file that the given user can see because it is inside a folder
+// shared with them. Returns sql.ErrNoRows if there is no such file.
+func lookupFolderFile(username, objectID string) (fileInfo, error) {
+	folderID, err := fileFolder(objectID)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	if folderID == "" {
+		return fileInfo{}, sql.ErrNoRows
+	}
+	ok, err := canAccessFolder(username, folderID)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	if !ok {
+		return fileInfo{}, sql.ErrNoRows
+	}
+
+	row := db.QueryRow("SELECT "+fileInfoColumns+" FROM files WHERE object_id = ? AND username = owner", objectID)
+	return scanFileInfo(row)
+}
+
+// Return all folders owned by the given user
+func listOwnFolders(username string) ([]folderInfo, error) {
+	rows, err := db.Query("SELECT id, name, owner, parent_id FROM folders WHERE owner = ? ORDER BY name", username)
+	if err != nil {
+		return nil, err
+	}
+	return scanFolders(rows)
+}
+
+// Return the subfolders of a folder that the given user may see
+func listSubfolders(username, folderID string) ([]folderInfo, error) {
+	var rows *sql.Rows
+	var err error
+	if folderID == "" {
+		// the top level holds the user's own folders and the folders others
+		// shared with them or their groups
+		rows, err = db.Query(`SELECT id, name, owner, parent_id FROM folders WHERE owner = ? AND parent_id = ''
+			UNION SELECT folders.id, folders.name, folders.owner, folders.parent_id FROM folders
+			JOIN folder_shares ON folder_shares.folder_id = folders.id WHERE folder_shares.username = ? AND folder_shares.pending = 0
+			UNION SELECT folders.id, folders.name, folders.owner, folders.parent_id FROM folders
+			JOIN folder_group_shares ON folder_group_shares.folder_id = folders.id
+			JOIN group_members ON group_members.group_id = folder_group_shares.group_id
+			WHERE group_members.username = ? AND group_members.pending = 0 AND folders.owner != ?
+			ORDER BY name`, username, username, username, username)
+	} else {
+		rows, err = db.Query("SELECT id, name, owner, parent_id FROM folders WHERE parent_id = ? ORDER BY name", folderID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanFolders(rows)
+}
+
+// Read folders from the result of a query selecting id, name, owner and parent_id
+func scanFolders(rows *sql.Rows) ([]folderInfo, error) {
+	defer rows.Close()
+
+	folders := make([]folderInfo, 0)
+	for rows.Next() {
+		var folder folderInfo
+		err := rows.Scan(&folder.ID, &folder.Name, &folder.Owner, &folder.Parent)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+// Entry point for requests to /folders/
+func handleFolderRequest(response http.ResponseWriter, request *http.Request, username string) {
+	path := strings.Split(strings.TrimPrefix(request.URL.Path, "/folders/"), "/")
+
+	switch {
+	case len(path) == 1 && path[0] == "":
+		createFolder(response, request, username)
+	case len(path) == 2 && path[1] == "rename":
+		renameFolder(response, request, username, path[0])
+	case len(path) == 2 && path[1] == "move":
+		moveFolder(response, request, username, path[0])
+	case len(path) == 2 && path[1] == "delete":
+		deleteFolder(response, request, username, path[0])
+	case len(path) == 2 && path[1] == "share":
+		shareFolder(response, request, username, path[0])
+	case len(path) == 2 && path[1] == "revoke":
+		revokeFolderShare(response, request, username, path[0])
+	case len(path) == 2 && path[1] == "transfer":
+		transferFolderOwnership(response, request, username, path[0])
+
+	default:
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "not found")
+	}
+}
+
+// Redirect back to the file list, showing the given folder
+func redirectToFolder(response http.ResponseWriter, request *http.Request, folderID string) {
+	target := "/list"
+	if folderID != "" {
+		target += "?folder=" + folderID
+	}
+	http.Redirect(response, request, target, http.StatusFound)
+}
+
+// Look up a folder owned by the given user.
+// Writes an error response and returns false if there is no such folder.
+func checkFolderRequest(response http.ResponseWriter, username, folderID string) (folder folderInfo, ok bool) {
+	folder, err := lookupFolder(folderID)
+	if err == sql.ErrNoRows || (err == nil && folder.Owner != username) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to modify folder")
+		return folder, false
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return folder, false
+	}
+	return folder, true
+}
+
+func createFolder(response http.ResponseWriter, request *http.Request, username string) {
+	name := request.FormValue("name")
+	parentID := request.FormValue("parent")
+
+	if !validFilename(name) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "invalid folder name")
+		return
+	}
+	err := checkFolderOwner(username, parentID)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	err = checkFolderNameFree(username, parentID, name, "")
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	parentPath, err := folderAncestors(parentID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if len(parentPath)+1 > maxFolderDepth {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "folders can't be nested more than %d deep", maxFolderDepth)
+		return
+	}
+
+	folderID, err := newObjectID()
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	_, err = db.Exec("INSERT INTO folders (id, owner, name, parent_id) VALUES (?, ?, ?, ?)", folderID, username, name, parentID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	redirectToFolder(response, request, parentID)
+}
+
+func renameFolder(response http.ResponseWriter, request *http.Request, username, folderID string) {
+	name := request.FormValue("name")
+
+	folder, ok := checkFolderRequest(response, username, folderID)
+	if !ok {
+		return
+	}
+	if !validFilename(name) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "invalid folder name")
+		return
+	}
+	err := checkFolderNameFree(username, folder.Parent, name, folderID)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	_, err = db.Exec("UPDATE folders SET name = ? WHERE id = ?", name, folderID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	redirectToFolder(response, request, folder.Parent)
+}
+
+func moveFolder(response http.ResponseWriter, request *http.Request, username, folderID string) {
+	parentID := request.FormValue("parent")
+
+	folder, ok := checkFolderRequest(response, username, folderID)
+	if !ok {
+		return
+	}
+	err := checkFolderOwner(username, parentID)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	// a folder can't be moved into itself or one of its own subfolders
+	newPath, err := folderAncestors(parentID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	for _, ancestor := range newPath {
+		if ancestor.ID == folderID {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, "can't move a folder into itself")
+			return
+		}
+	}
+
+	height, err := folderHeight(folderID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if len(newPath)+height > maxFolderDepth {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "folders can't be nested more than %d deep", maxFolderDepth)
+		return
+	}
+
+	err = checkFolderNameFree(username, parentID, folder.Name, folderID)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	_, err = db.Exec("UPDATE folders SET parent_id = ? WHERE id = ?", parentID, folderID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	redirectToFolder(response, request, parentID)
+}
+
+// Delete a folder. Only empty folders can be deleted.
+func deleteFolder(response http.ResponseWriter, request *http.Request, username, folderID string) {
+	folder, ok := checkFolderRequest(response, username, folderID)
+	if !ok {
+		return
+	}
+
+	var count int
+	row := db.QueryRow("SELECT (SELECT COUNT(*) FROM folders WHERE parent_id = ?) + (SELECT COUNT(*) FROM files WHERE folder_id = ?)", folderID, folderID)
+	err := row.Scan(&count)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if count > 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "folder is not empty")
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM folder_shares WHERE folder_id = ?", folderID)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM folder_group_shares WHERE folder_id = ?", folderID)
+	}
+	if err == nil {
+		_, err = db.Exec("DELETE FROM folders WHERE id = ?", folderID)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	redirectToFolder(response, request, folder.Parent)
+}
+
+// Share a folder, and everything that is or will be inside it, with another
+// user or with a group
+func shareFolder(response http.ResponseWriter, request *http.Request, sender, folderID string) {
+	recipient := request.FormValue("username")
+	groupName := request.FormValue("group")
+	role := request.FormValue("role")
+	if role == "" {
+		role = roleViewer
+	}
+
+	folder, ok := checkFolderSharer(response, sender, folderID)
+	if !ok {
+		return
+	}
+	if !validShareRole(role) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "invalid role")
+		return
+	}
+
+	// sharing the folder again only changes the recipient's role
+	var err error
+	if groupName != "" {
+		group, ok := checkShareGroup(response, sender, groupName)
+		if !ok {
+			return
+		}
+		_, err = db.Exec("INSERT OR REPLACE INTO folder_group_shares (folder_id, owner, group_id, role) VALUES (?, ?, ?, ?)", folderID, folder.Owner, group.ID, role)
+	} else {
+		if sender == recipient || recipient == folder.Owner {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, "can't share with yourself")
+			return
+		}
+		err = shareFolderWithUser(folder, sender, recipient, role)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	redirectToFolder(response, request, folder.Parent)
+}
+
+// Share a folder with a user. Sharing it again only changes their role.
+func shareFolderWithUser(folder folderInfo, sender, recipient, role string) error {
+	result, err := db.Exec("UPDATE folder_shares SET role = ? WHERE folder_id = ? AND username = ?", role, folder.ID, recipient)
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count > 0 {
+		return nil
+	}
+
+	// a new share waits in the recipient's inbox unless they accept shares
+	// from the sender automatically
+	pending, err := sharePending(recipient, sender)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO folder_shares (folder_id, owner, username, role, pending) VALUES (?, ?, ?, ?, ?)", folder.ID, folder.Owner, recipient, role, pending)
+	if err != nil || !pending {
+		return err
+	}
+	return notifyInvitation(recipient, sender, folder.Name)
+}
@@ -1,6 +1,6 @@
 module server
 
-go 1.12
+go 1.19
 
 require (
 	astuart.co/go-robinhood v1.5.0
@@ -8,3 +8,5 @@ require (
 	github.com/sirupsen/logrus v1.4.2
 	golang.org/x/crypto v0.0.0-20190313024323-a1f597ede03a
 )
+
+require golang.org/x/sys v0.0.0-20190422165155-953cdadca894 // indirect
@@ -0,0 +1,408 @@
+// User groups.
+//
+// Anyone can create a named group and invite people to it. Invitations
+// wait in the invitee's inbox until they accept them. Files and
+// folders shared with a group are available to everyone who is a member
+// at the time they are accessed, so people who join later get access to
+// everything shared with the group before, and people who leave lose it.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Size of group IDs
+const groupIDSizeBytes = 16
+
+// groupInfo helps you pass information about a group to the template
+type groupInfo struct {
+	ID      string
+	Name    string
+	Owner   string
+	Members []string
+	Invited []string // people who haven't accepted their invitation yet
+}
+
+// Look up a group by its name
+func lookupGroupByName(name string) (group groupInfo, err error) {
+	row := db.QueryRow("SELECT id, name, owner FROM user_groups WHERE name = ?", name)
+	err = row.Scan(&group.ID, &group.Name, &group.Owner)
+	return
+}
+
+// Look up the group named in a share or revoke request.
+// Writes an error response and returns false if there is no such group.
+func checkGroupName(response http.ResponseWriter, name string) (group groupInfo, ok bool) {
+	group, err := lookupGroupByName(name)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "no such group %s", name)
+		return group, false
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return group, false
+	}
+	return group, true
+}
+
+// Look up the group named in a share request. People may only share with
+// groups they are a member of.
+// Writes an error response and returns false if they can't share with it.
+func checkShareGroup(response http.ResponseWriter, sender, name string) (group groupInfo, ok bool) {
+	group, ok = checkGroupName(response, name)
+	if !ok {
+		return group, false
+	}
+	member, err := isGroupMember(group.ID, sender)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return group, false
+	}
+	if !member {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "you can only share with groups you are a member of")
+		return group, false
+	}
+	return group, true
+}
+
+// Return true if the given user is a member of a group
+func isGroupMember(groupID, username string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND username = ? AND pending = 0", groupID, username).Scan(&count)
+	return count > 0, err
+}
+
+// Look up a file that the given user can see because it is shared with one
+// of their groups. Returns sql.ErrNoRows if there is no such file.
+func lookupGroupFile(username, objectID string) (fileInfo, error) {
+	role, err := strongestRole(`SELECT file_group_shares.role FROM file_group_shares
+		JOIN group_members ON group_members.group_id = file_group_shares.group_id
+		WHERE file_group_shares.object_id = ? AND group_members.username = ? AND group_members.pending = 0`, objectID, username)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	if role == "" {
+		return fileInfo{}, sql.ErrNoRows
+	}
+
+	row := db.QueryRow("SELECT "+fileInfoColumns+" FROM files WHERE object_id = ? AND username = owner", objectID)
+	file, err := scanFileInfo(row)
+	file.Role = role
+	return file, err
+}
+
+// Share a file with a group. Sharing it again only changes the group's role.
+func shareFileWithGroup(response http.ResponseWriter, sender, objectID, groupName, role string) {
+	group, ok := checkShareGroup(response, sender, groupName)
+	if !ok {
+		return
+	}
+
+	owner, err := fileOwner(objectID)
+	if err == nil {
+		_, err = db.Exec("INSERT OR REPLACE INTO file_group_shares (object_id, owner, group_id, role) VALUES (?, ?, ?, ?)", objectID, owner, group.ID, role)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	fmt.Fprintf(response, "file shared")
+}
+
+// Return the groups the given user owns or is a member of, with their members
+func listGroups(username string) ([]groupInfo, error) {
+	rows, err := db.Query(`SELECT id, name, owner FROM user_groups WHERE owner = ?
+		UNION SELECT user_groups.id, user_groups.name, user_groups.owner FROM user_groups
+		JOIN group_members ON group_members.group_id = user_groups.id WHERE group_members.username = ? AND group_members.pending = 0
+		ORDER BY name`, username, username)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]groupInfo, 0)
+	for rows.Next() {
+		var group groupInfo
+		err = rows.Scan(&group.ID, &group.Name, &group.Owner)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	rows.Close()
+
+	for i := range groups {
+		memberRows, err := db.Query("SELECT username, pending FROM group_members WHERE group_id = ? ORDER BY username", groups[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for memberRows.Next() {
+			var member string
+			var pending bool
+			err = memberRows.Scan(&member, &pending)
+			if err != nil {
+				memberRows.Close()
+				return nil, err
+			}
+			if pending {
+				groups[i].Invited = append(groups[i].Invited, member)
+			} else {
+				groups[i].Members = append(groups[i].Members, member)
+			}
+		}
+		memberRows.Close()
+	}
+	return groups, nil
+}
+
+// Entry point for requests to /groups and /groups/{id}/{action}
+func handleGroupRequest(response http.ResponseWriter, request *http.Request, username string) {
+	path := strings.Split(strings.TrimPrefix(request.URL.Path, "/groups"), "/")
+
+	switch {
+	case len(path) == 1 && request.Method == "GET":
+		showGroups(response, request, username)
+	case len(path) == 1 && request.Method == "POST":
+		createGroup(response, request, username)
+	case len(path) == 3 && path[2] == "add" && request.Method == "POST":
+		addGroupMember(response, request, username, path[1])
+	case len(path) == 3 && path[2] == "remove" && request.Method == "POST":
+		removeGroupMember(response, request, username, path[1])
+	case len(path) == 3 && path[2] == "delete" && request.Method == "POST":
+		deleteGroup(response, request, username, path[1])
+	case len(path) == 3 && path[2] == "leave" && request.Method == "POST":
+		leaveGroup(response, request, username, path[1])
+
+	default:
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "not found")
+	}
+}
+
+// Show the groups the user owns or is a member of
+func showGroups(response http.ResponseWriter, request *http.Request, username string) {
+	groups, err := listGroups(username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Username": username,
+		"Groups":   groups,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/groups.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Create a group, with its owner as the first member
+func createGroup(response http.ResponseWriter, request *http.Request, username string) {
+	name := request.FormValue("name")
+
+	if !validFilename(name) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "invalid group name")
+		return
+	}
+	_, err := lookupGroupByName(name)
+	if err == nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "group %s already exists", name)
+		return
+	} else if err != sql.ErrNoRows {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	groupID, err := randomByteString(groupIDSizeBytes)
+	if err == nil {
+		_, err = db.Exec("INSERT INTO user_groups (id, name, owner) VALUES (?, ?, ?)", groupID, name, username)
+	}
+	if err == nil {
+		_, err = db.Exec("INSERT INTO group_members (group_id, username, pending) VALUES (?, ?, 0)", groupID, username)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/groups", http.StatusFound)
+}
+
+// Look up a group owned by the given user.
+// Writes an error response and returns false if there is no such group.
+func checkGroupOwner(response http.ResponseWriter, username, groupID string) (group groupInfo, ok bool) {
+	row := db.QueryRow("SELECT id, name, owner FROM user_groups WHERE id = ?", groupID)
+	err := row.Scan(&group.ID, &group.Name, &group.Owner)
+	if err == sql.ErrNoRows || (err == nil && group.Owner != username) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to modify group")
+		return group, false
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return group, false
+	}
+	return group, true
+}
+
+// Return an error unless the given user has an account
+func checkUserExists(username string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no such user %s", username)
+	}
+	return nil
+}
+
+// Invite someone to a group. They become a member once they accept, or
+// straight away if they accept invitations from the owner automatically.
+func addGroupMember(response http.ResponseWriter, request *http.Request, username, groupID string) {
+	member := request.FormValue("username")
+
+	group, ok := checkGroupOwner(response, username, groupID)
+	if !ok {
+		return
+	}
+	err := checkUserExists(member)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	pending, err := sharePending(member, username)
+	if err == nil {
+		var result sql.Result
+		result, err = db.Exec("INSERT OR IGNORE INTO group_members (group_id, username, pending) VALUES (?, ?, ?)", groupID, member, pending)
+		if err == nil && pending {
+			// only tell people about new invitations
+			if count, _ := result.RowsAffected(); count > 0 {
+				err = notify(member, fmt.Sprintf("%s invited you to the group %s. Accept or decline it in your inbox.", username, group.Name))
+			}
+		}
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/groups", http.StatusFound)
+}
+
+// Take a member out of a group, or take back their invitation. The owner
+// always stays a member.
+func removeGroupMember(response http.ResponseWriter, request *http.Request, username, groupID string) {
+	member := request.FormValue("username")
+
+	group, ok := checkGroupOwner(response, username, groupID)
+	if !ok {
+		return
+	}
+	if member == group.Owner {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "the owner can't leave the group")
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM group_members WHERE group_id = ? AND username = ?", groupID, member)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "%s is not a member of the group", member)
+		return
+	}
+
+	http.Redirect(response, request, "/groups", http.StatusFound)
+}
+
+// Leave a group the user is a member of, along with their rule accepting
+// shares from its members. The owner can only delete the group.
+func leaveGroup(response http.ResponseWriter, request *http.Request, username, groupID string) {
+	var owner string
+	err := db.QueryRow("SELECT owner FROM user_groups WHERE id = ?", groupID).Scan(&owner)
+	if err == nil && owner == username {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "the owner can't leave the group")
+		return
+	}
+
+	var result sql.Result
+	if err == nil {
+		result, err = db.Exec("DELETE FROM group_members WHERE group_id = ? AND username = ? AND pending = 0", groupID, username)
+	}
+	if err == nil {
+		if count, _ := result.RowsAffected(); count == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "you are not a member of the group")
+		return
+	}
+	if err == nil {
+		_, err = db.Exec("DELETE FROM auto_accept WHERE username = ? AND group_id = ?", username, groupID)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/groups", http.StatusFound)
+}
+
+// Delete a group, along with everything shared with it
+func deleteGroup(response http.ResponseWriter, request *http.Request, username, groupID string) {
+	_, ok := checkGroupOwner(response, username, groupID)
+	if !ok {
+		return
+	}
+
+	var err error
+	for _, table := range []string{"file_group_shares", "folder_group_shares", "group_members", "auto_accept"} {
+		_, err = db.Exec("DELETE FROM "+table+" WHERE group_id = ?", groupID)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = db.Exec("DELETE FROM user_groups WHERE id = ?", groupID)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/groups", http.StatusFound)
+}
@@ -3,12 +3,12 @@ package main
 
 import (
 	"crypto/rand"
-	"encoding/base64"
 	"encoding/hex"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"os"
-
-	"golang.org/x/crypto/argon2"
+	"strings"
+	"time"
 )
 
 // Return true if the given path exists
@@ -31,11 +31,41 @@ func randomByteString(numBytes int) (random string, err error) {
 	return random, err
 }
 
-// Hash the password with the provided salt, using reasonable defaults
-func hashPassword(password string, salt string) (hashedPassword string) {
-	hashedPasswordBytes := argon2.IDKey([]byte(password), []byte(salt), 1, 64*1024, 1, 32)
-	hashedPassword = base64.StdEncoding.EncodeToString(hashedPasswordBytes)
-	return
+// Load the administrators from the comma-separated list in the environment
+// variable named by adminUsersVariable
+func loadAdminUsers() {
+	for _, username := range strings.Split(os.Getenv(adminUsersVariable), ",") {
+		username = strings.TrimSpace(username)
+		if username != "" {
+			adminUsers[username] = true
+		}
+	}
+}
+
+// Return true if the given user is an administrator
+func isAdmin(username string) bool {
+	return adminUsers[username]
+}
+
+// Format a number of bytes for people to read, e.g. "1.5 MB"
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// Call fn every interval, forever. Meant to be run in its own goroutine.
+func runPeriodically(interval time.Duration, fn func()) {
+	for range time.Tick(interval) {
+		fn()
+	}
 }
 
 // Called to fully reset the state of the application
@@ -0,0 +1,322 @@
+// Share inbox.
+//
+// Files and folders shared with someone directly arrive as pending
+// invitations, which give no access until the recipient accepts them from
+// /inbox. Being added to a group is an invitation too, so nothing shared
+// with a group reaches people who haven't agreed to be in it. Declining an
+// invitation removes the share or the membership. Recipients can choose
+// to accept invitations automatically when they come from particular
+// users, or from anyone in a group they are a member of.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// autoAcceptInfo helps you pass information about an auto-accept rule to the template
+type autoAcceptInfo struct {
+	ID     int64
+	Sender string // set for rules accepting shares from a user
+	Group  string // set for rules accepting shares from members of a group
+}
+
+// Return true if a share from sender to recipient should wait for the
+// recipient to accept it
+func sharePending(recipient, sender string) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM auto_accept WHERE username = ? AND (sender = ?
+		OR group_id IN (SELECT group_id FROM group_members WHERE username = ? AND pending = 0
+			INTERSECT SELECT group_id FROM group_members WHERE username = ? AND pending = 0))`,
+		recipient, sender, sender, recipient).Scan(&count)
+	return count == 0, err
+}
+
+// Tell the recipient of a pending share that it is waiting in their inbox
+func notifyInvitation(recipient, sender, name string) error {
+	return notify(recipient, fmt.Sprintf("%s wants to share %s with you. Accept or decline it in your inbox.", sender, name))
+}
+
+// Entry point for requests to /inbox, /inbox/{file|folder|group|transfer}/{id}/{accept|decline},
+// /inbox/auto-accept and /inbox/auto-accept/{id}/remove
+func handleInboxRequest(response http.ResponseWriter, request *http.Request, username string) {
+	path := strings.Split(strings.TrimPrefix(request.URL.Path, "/inbox"), "/")
+
+	switch {
+	case len(path) == 1 && request.Method == "GET":
+		showInbox(response, request, username)
+	case len(path) == 2 && path[1] == "auto-accept" && request.Method == "POST":
+		addAutoAccept(response, request, username)
+	case len(path) == 4 && path[1] == "auto-accept" && path[3] == "remove" && request.Method == "POST":
+		removeAutoAccept(response, request, username, path[2])
+	case len(path) == 4 && path[1] == "file" && path[3] == "accept" && request.Method == "POST":
+		acceptFileShare(response, request, username, path[2])
+	case len(path) == 4 && path[1] == "file" && path[3] == "decline" && request.Method == "POST":
+		declineFileShare(response, request, username, path[2])
+	case len(path) == 4 && path[1] == "folder" && path[3] == "accept" && request.Method == "POST":
+		acceptFolderShare(response, request, username, path[2])
+	case len(path) == 4 && path[1] == "folder" && path[3] == "decline" && request.Method == "POST":
+		declineFolderShare(response, request, username, path[2])
+	case len(path) == 4 && path[1] == "group" && path[3] == "accept" && request.Method == "POST":
+		acceptGroupInvitation(response, request, username, path[2])
+	case len(path) == 4 && path[1] == "group" && path[3] == "decline" && request.Method == "POST":
+		declineGroupInvitation(response, request, username, path[2])
+	case len(path) == 4 && path[1] == "transfer" && path[3] == "accept" && request.Method == "POST":
+		acceptTransferOffer(response, request, username, path[2])
+	case len(path) == 4 && path[1] == "transfer" && path[3] == "decline" && request.Method == "POST":
+		declineTransferOffer(response, request, username, path[2])
+
+	default:
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "not found")
+	}
+}
+
+// Show the user's pending invitations and auto-accept rules
+func showInbox(response http.ResponseWriter, request *http.Request, username string) {
+	rows, err := db.Query("SELECT "+fileInfoColumns+" FROM files WHERE username = ? AND pending = 1 ORDER BY filename", username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	files := make([]fileInfo, 0)
+	for rows.Next() {
+		file, err := scanFileInfo(rows)
+		if err != nil {
+			rows.Close()
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT folders.id, folders.name, folders.owner, folders.parent_id, folder_shares.role FROM folder_shares
+		JOIN folders ON folders.id = folder_shares.folder_id WHERE folder_shares.username = ? AND folder_shares.pending = 1
+		ORDER BY folders.name`, username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	folders := make([]folderInfo, 0)
+	for rows.Next() {
+		var folder folderInfo
+		err = rows.Scan(&folder.ID, &folder.Name, &folder.Owner, &folder.Parent, &folder.Role)
+		if err != nil {
+			rows.Close()
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		folders = append(folders, folder)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT user_groups.id, user_groups.name, user_groups.owner FROM group_members
+		JOIN user_groups ON user_groups.id = group_members.group_id WHERE group_members.username = ? AND group_members.pending = 1
+		ORDER BY user_groups.name`, username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	groups := make([]groupInfo, 0)
+	for rows.Next() {
+		var group groupInfo
+		err = rows.Scan(&group.ID, &group.Name, &group.Owner)
+		if err != nil {
+			rows.Close()
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		groups = append(groups, group)
+	}
+	rows.Close()
+
+	transfers, err := listTransferOffers(username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	rules, err := listAutoAccept(username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Username":   username,
+		"Files":      files,
+		"Folders":    folders,
+		"Groups":     groups,
+		"Transfers":  transfers,
+		"AutoAccept": rules,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/inbox.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Return the given user's auto-accept rules, users first, then groups
+func listAutoAccept(username string) ([]autoAcceptInfo, error) {
+	rows, err := db.Query(`SELECT auto_accept.id, auto_accept.sender, IFNULL(user_groups.name, '') FROM auto_accept
+		LEFT JOIN user_groups ON user_groups.id = auto_accept.group_id
+		WHERE auto_accept.username = ? ORDER BY auto_accept.group_id != '', 2, 3`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]autoAcceptInfo, 0)
+	for rows.Next() {
+		var rule autoAcceptInfo
+		err = rows.Scan(&rule.ID, &rule.Sender, &rule.Group)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// Accept future shares from a user, given by the form value username, or
+// from the members of one of the user's groups, given by the form value group
+func addAutoAccept(response http.ResponseWriter, request *http.Request, username string) {
+	sender := request.FormValue("username")
+	groupName := request.FormValue("group")
+
+	var groupID string
+	if groupName != "" {
+		group, ok := checkGroupName(response, groupName)
+		if !ok {
+			return
+		}
+		member, err := isGroupMember(group.ID, username)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		if !member {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, "you can only accept shares from groups you are a member of")
+			return
+		}
+		groupID, sender = group.ID, ""
+	} else {
+		err := checkUserExists(sender)
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+	}
+
+	_, err := db.Exec("INSERT OR IGNORE INTO auto_accept (username, sender, group_id) VALUES (?, ?, ?)", username, sender, groupID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/inbox", http.StatusFound)
+}
+
+// Stop accepting shares automatically under one of the user's rules
+func removeAutoAccept(response http.ResponseWriter, request *http.Request, username, ruleID string) {
+	result, err := db.Exec("DELETE FROM auto_accept WHERE id = ? AND username = ?", ruleID, username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "no such rule")
+		return
+	}
+
+	http.Redirect(response, request, "/inbox", http.StatusFound)
+}
+
+// Write the response to accepting or declining an invitation, given the
+// result of the statement that did it
+func finishInvitation(response http.ResponseWriter, request *http.Request, result sql.Result, err error) {
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "no such invitation")
+		return
+	}
+
+	http.Redirect(response, request, "/inbox", http.StatusFound)
+}
+
+func acceptFileShare(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	result, err := db.Exec("UPDATE files SET pending = 0 WHERE object_id = ? AND username = ? AND pending = 1", objectID, username)
+	finishInvitation(response, request, result, err)
+}
+
+func acceptFolderShare(response http.ResponseWriter, request *http.Request, username, folderID string) {
+	result, err := db.Exec("UPDATE folder_shares SET pending = 0 WHERE folder_id = ? AND username = ? AND pending = 1", folderID, username)
+	finishInvitation(response, request, result, err)
+}
+
+// Decline a file shared with the user, removing their copy of it
+func declineFileShare(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	digests, err := queryDigests(db, "SELECT digest FROM files WHERE object_id = ? AND username = ? AND pending = 1", objectID, username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM files WHERE object_id = ? AND username = ? AND pending = 1", objectID, username)
+	if err == nil {
+		// the declined rows no longer refer to the contents
+		for _, digest := range digests {
+			err = releaseBlob(digest)
+			if err != nil {
+				break
+			}
+		}
+	}
+	finishInvitation(response, request, result, err)
+}
+
+func declineFolderShare(response http.ResponseWriter, request *http.Request, username, folderID string) {
+	result, err := db.Exec("DELETE FROM folder_shares WHERE folder_id = ? AND username = ? AND pending = 1", folderID, username)
+	finishInvitation(response, request, result, err)
+}
+
+func acceptGroupInvitation(response http.ResponseWriter, request *http.Request, username, groupID string) {
+	result, err := db.Exec("UPDATE group_members SET pending = 0 WHERE group_id = ? AND username = ? AND pending = 1", groupID, username)
+	finishInvitation(response, request, result, err)
+}
+
+func declineGroupInvitation(response http.ResponseWriter, request *http.Request, username, groupID string) {
+	result, err := db.Exec("DELETE FROM group_members WHERE group_id = ? AND username = ? AND pending = 1", groupID, username)
+	finishInvitation(response, request, result, err)
+}
@@ -0,0 +1,313 @@
+// Public share links.
+//
+// A share link lets anyone who knows its token download a file without an
+// account, through /s/{token}. Links may expire at a given time, stop
+// working after a number of downloads and require a password. Whoever may
+// share a file may create links to it, and revoke them again from /links.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Size of link tokens; long enough that they can't be guessed
+const linkTokenSizeBytes = 32
+
+// linkInfo helps you pass information about a share link to the template
+type linkInfo struct {
+	Token        string
+	Filename     string
+	Creator      string
+	Created      time.Time
+	Expires      time.Time // zero if the link never expires
+	MaxDownloads int64     // zero if the number of downloads is unlimited
+	Downloads    int64
+	HasPassword  bool
+}
+
+// Entry point for requests to /links and /links/{token}/revoke
+func handleLinkRequest(response http.ResponseWriter, request *http.Request, username string) {
+	path := strings.Split(strings.TrimPrefix(request.URL.Path, "/links"), "/")
+
+	switch {
+	case len(path) == 1 && request.Method == "GET":
+		listLinks(response, request, username)
+	case len(path) == 1 && request.Method == "POST":
+		createLink(response, request, username)
+	case len(path) == 3 && path[2] == "revoke" && request.Method == "POST":
+		revokeLink(response, request, username, path[1])
+
+	default:
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "not found")
+	}
+}
+
+// Show the links to files the user owns or shared themselves, along with
+// a form for creating new ones
+func listLinks(response http.ResponseWriter, request *http.Request, username string) {
+	rows, err := db.Query(`SELECT share_links.token, files.filename, share_links.username, share_links.created,
+			share_links.expires, share_links.max_downloads, share_links.downloads, share_links.password != ''
+		FROM share_links JOIN files ON files.object_id = share_links.object_id AND files.username = files.owner
+		WHERE share_links.username = ? OR files.owner = ? ORDER BY share_links.created DESC`, username, username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	links := make([]linkInfo, 0)
+	for rows.Next() {
+		var link linkInfo
+		var created, expires int64
+		err = rows.Scan(&link.Token, &link.Filename, &link.Creator, &created, &expires, &link.MaxDownloads, &link.Downloads, &link.HasPassword)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		link.Created = time.Unix(created, 0)
+		if expires != 0 {
+			link.Expires = time.Unix(expires, 0)
+		}
+		links = append(links, link)
+	}
+
+	// links can be created for the user's own files
+	fileRows, err := db.Query("SELECT "+fileInfoColumns+" FROM files WHERE username = ? AND username = owner ORDER BY filename", username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	defer fileRows.Close()
+
+	files := make([]fileInfo, 0)
+	for fileRows.Next() {
+		file, err := scanFileInfo(fileRows)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		files = append(files, file)
+	}
+
+	data := map[string]interface{}{
+		"Username": username,
+		"Links":    links,
+		"Files":    files,
+		"File":     request.URL.Query().Get("file"),
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/links.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Create a share link to a file. The expiry, download limit and password
+// are all optional.
+func createLink(response http.ResponseWriter, request *http.Request, username string) {
+	objectID := request.FormValue("file")
+
+	ok := checkFileSharer(response, username, objectID)
+	if !ok {
+		return
+	}
+
+	var expires int64
+	if value := request.FormValue("expires"); value != "" {
+		expiry, err := time.ParseInLocation("2006-01-02T15:04", value, time.Local)
+		if err != nil || expiry.Before(time.Now()) {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, "invalid expiry date")
+			return
+		}
+		expires = expiry.Unix()
+	}
+
+	var maxDownloads int64
+	if value := request.FormValue("max_downloads"); value != "" {
+		var err error
+		maxDownloads, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || maxDownloads < 0 {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(response, "invalid download limit")
+			return
+		}
+	}
+
+	token, err := randomByteString(linkTokenSizeBytes)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	// passwords are stored like account passwords
+	var hashedPassword string
+	if password := request.FormValue("password"); password != "" {
+		hashedPassword, err = hashPassword(password)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+	}
+
+	// the salt is part of the hash
+	_, err = db.Exec("INSERT INTO share_links VALUES (?, ?, ?, ?, ?, ?, 0, ?, '')",
+		token, objectID, username, time.Now().Unix(), expires, maxDownloads, hashedPassword)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/links", http.StatusFound)
+}
+
+// Delete a share link. Links may be revoked by whoever created them, and by
+// anyone who may share the file.
+func revokeLink(response http.ResponseWriter, request *http.Request, username, token string) {
+	var objectID, creator string
+	err := db.QueryRow("SELECT object_id, username FROM share_links WHERE token = ?", token).Scan(&objectID, &creator)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "no such link")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if creator != username {
+		ok := checkFileSharer(response, username, objectID)
+		if !ok {
+			return
+		}
+	}
+
+	_, err = db.Exec("DELETE FROM share_links WHERE token = ?", token)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/links", http.StatusFound)
+}
+
+// Handle requests to /s/{token}: download a file through a share link.
+// Links with a password show a form asking for it first.
+func getLinkedFile(response http.ResponseWriter, request *http.Request) {
+	token := strings.TrimPrefix(request.URL.Path, "/s/")
+
+	var objectID, hashedPassword, salt string
+	var expires, maxDownloads, downloads int64
+	row := db.QueryRow("SELECT object_id, expires, max_downloads, downloads, password, salt FROM share_links WHERE token = ?", token)
+	err := row.Scan(&objectID, &expires, &maxDownloads, &downloads, &hashedPassword, &salt)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "no such link")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if (expires != 0 && time.Now().Unix() >= expires) || (maxDownloads != 0 && downloads >= maxDownloads) {
+		response.WriteHeader(http.StatusGone)
+		fmt.Fprint(response, "link has expired")
+		return
+	}
+
+	file, err := scanFileInfo(db.QueryRow("SELECT "+fileInfoColumns+" FROM files WHERE object_id = ? AND username = owner", objectID))
+	if err == sql.ErrNoRows {
+		// the file is in the trash
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "no such link")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	if hashedPassword != "" {
+		if request.Method != "POST" {
+			showLinkPasswordPage(response, file, "")
+			return
+		}
+		// guesses are throttled per link and per address, like logins
+		if !claimAttempt(response, request, linkThrottle, token) {
+			return
+		}
+		correct, _, err := verifyPassword(request.FormValue("password"), hashedPassword, salt)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		if !correct {
+			response.WriteHeader(http.StatusUnauthorized)
+			showLinkPasswordPage(response, file, "incorrect password")
+			return
+		}
+		attemptSucceeded(request, linkThrottle, token)
+	}
+
+	// a client revalidating its copy isn't downloading the file again
+	if notModified(request, file) {
+		serveFile(response, request, file)
+		return
+	}
+
+	// count the download, unless someone else used up the last one meanwhile.
+	// Resuming a download with a range request counts too, or ranges could
+	// be used to fetch the whole file without ever using up the link.
+	result, err := db.Exec("UPDATE share_links SET downloads = downloads + 1 WHERE token = ? AND (max_downloads = 0 OR downloads < max_downloads)", token)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		response.WriteHeader(http.StatusGone)
+		fmt.Fprint(response, "link has expired")
+		return
+	}
+
+	serveFile(response, request, file)
+}
+
+// Show the form asking for a share link's password
+func showLinkPasswordPage(response http.ResponseWriter, file fileInfo, message string) {
+	data := map[string]interface{}{
+		"Filename": file.Filename,
+		"Error":    message,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/link.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,104 @@
+// Sending email, e.g. password reset links.
+//
+// Mail goes through the mailSender in mailer, which loadMailSender picks
+// from the environment: an SMTP server if mailServerVariable is set,
+// otherwise files in the directory named by mailDirVariable, otherwise the
+// log. The last two are meant for development and tests.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mailSender delivers email
+type mailSender interface {
+	Send(to, subject, body string) error
+}
+
+// The mail sender in use
+var mailer mailSender = logMailSender{}
+
+// Pick the mail sender from the environment
+func loadMailSender() {
+	from := os.Getenv(mailFromVariable)
+	if from == "" {
+		from = defaultMailFrom
+	}
+
+	if server := os.Getenv(mailServerVariable); server != "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			host = server
+		}
+		sender := smtpMailSender{Server: server, From: from}
+		if user := os.Getenv(mailUserVariable); user != "" {
+			sender.Auth = smtp.PlainAuth("", user, os.Getenv(mailPasswordVariable), host)
+		}
+		mailer = sender
+	} else if dir := os.Getenv(mailDirVariable); dir != "" {
+		mailer = fileMailSender{Dir: dir, From: from}
+	} else {
+		log.Warnf("neither %s nor %s is set, email will only be logged", mailServerVariable, mailDirVariable)
+		mailer = logMailSender{}
+	}
+}
+
+// Return a message with the given headers and body, in the format SMTP
+// servers expect
+func formatMail(from, to, subject, body string) string {
+	// keep headers on one line each, so they can't be used to add others
+	clean := strings.NewReplacer("\r", "", "\n", " ")
+	return "From: " + clean.Replace(from) + "\r\n" +
+		"To: " + clean.Replace(to) + "\r\n" +
+		"Subject: " + clean.Replace(subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+}
+
+// smtpMailSender sends mail through an SMTP server
+type smtpMailSender struct {
+	Server string // host:port
+	From   string
+	Auth   smtp.Auth // nil if the server doesn't need logging in to
+}
+
+func (sender smtpMailSender) Send(to, subject, body string) error {
+	return smtp.SendMail(sender.Server, sender.Auth, sender.From, []string{to}, []byte(formatMail(sender.From, to, subject, body)))
+}
+
+// fileMailSender writes each message to a new file in a directory
+type fileMailSender struct {
+	Dir  string
+	From string
+}
+
+func (sender fileMailSender) Send(to, subject, body string) error {
+	err := os.MkdirAll(sender.Dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	suffix, err := randomByteString(4)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), suffix)
+	return ioutil.WriteFile(filepath.Join(sender.Dir, name), []byte(formatMail(sender.From, to, subject, body)), 0600)
+}
+
+// logMailSender writes messages to the log instead of sending them
+type logMailSender struct{}
+
+func (logMailSender) Send(to, subject, body string) error {
+	log.Infof("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -13,6 +14,97 @@ import (
 // Configuration & settings
 const sessionDuration = 24 * time.Hour
 const filePath = "./files"
+const maxUploadSize = 1 << 30 // bytes
+const uploadExpiration = 24 * time.Hour
+const uploadPurgeInterval = time.Hour
+const trashRetention = 30 * 24 * time.Hour
+const trashPurgeInterval = time.Hour
+const maxFolderDepth = 100
+
+// Storage quotas: every user may store defaultQuota bytes,
+// unless quotaOverrides lists a different amount for them. Overrides are
+// read from the environment variable quotaOverridesVariable, e.g.
+// "alice=20GB,bob=512MB".
+const defaultQuota = 10 << 30 // bytes
+const quotaOverridesVariable = "UNICORNBOX_QUOTAS"
+
+var quotaOverrides = map[string]int64{}
+
+// Signed download URLs last signedURLDuration unless asked otherwise.
+// Signing keys are read from the environment variable signingKeysVariable.
+const signedURLDuration = 15 * time.Minute
+const signedURLMaxDuration = 7 * 24 * time.Hour
+const signingKeysVariable = "UNICORNBOX_SIGNING_KEYS"
+
+// Two-factor authentication uses codes of totpDigits digits that change
+// every totpPeriod, accepting codes up to totpSkew periods early or late.
+// After entering their password, users have loginChallengeDuration and
+// maxTwoFactorAttempts tries to enter a code.
+const totpIssuer = "UnicornBox"
+const totpDigits = 6
+const totpPeriod = 30 * time.Second
+const totpSkew = 1
+const recoveryCodeCount = 10
+const loginChallengeDuration = 5 * time.Minute
+const maxTwoFactorAttempts = 5
+
+// Failed logins are throttled per account and per IP address: after the
+// free attempts, each failure doubles the wait before the next attempt,
+// starting at loginBackoffBase, and the lockout number of failures blocks
+// logins for loginLockoutDuration. Addresses may be shared by many people,
+// so they get more attempts. Passwords of share links are throttled the
+// same way, per link and per address.
+const freeAccountLoginAttempts = 3
+const accountLockoutFailures = 10
+const freeAddressLoginAttempts = 20
+const addressLockoutFailures = 100
+const loginBackoffBase = time.Second
+const loginBackoffMax = 5 * time.Minute
+const loginLockoutDuration = time.Hour
+const freeLinkPasswordAttempts = 5
+const linkLockoutFailures = 20
+
+// Password reset links work once, for passwordResetDuration, and at most
+// one is sent to an account every passwordResetRequestInterval
+const passwordResetDuration = time.Hour
+const passwordResetRequestInterval = time.Minute
+
+// Passwords are hashed with argon2id using these parameters. Hashes made
+// with weaker ones are upgraded when their user next logs in.
+const passwordHashTime = 3
+const passwordHashMemory = 64 * 1024 // KiB
+const passwordHashThreads = 2
+const passwordHashKeyLength = 32
+const passwordSaltSizeBytes = 16
+
+// New passwords must be at least minPasswordLength characters long, must
+// differ from the username, and must not be in the list of common passwords
+// in commonPasswordsPath. New usernames must match usernamePattern, which
+// usernameRules describes for people signing up.
+const minPasswordLength = 8
+const commonPasswordsPath = "./data/common-passwords.txt"
+const usernamePattern = `^[a-zA-Z0-9][a-zA-Z0-9_.-]{2,31}$`
+const usernameRules = "Usernames must be 3 to 32 characters long, use only letters, digits, '_', '.' and '-', and start with a letter or digit."
+
+// Mail is sent through the SMTP server in mailServerVariable ("host:port"),
+// logging in with mailUserVariable and mailPasswordVariable if set. Without
+// a server it is written to files in mailDirVariable, or else to the log.
+// Links in mail point to the address in siteURLVariable.
+const mailServerVariable = "UNICORNBOX_SMTP_SERVER"
+const mailUserVariable = "UNICORNBOX_SMTP_USER"
+const mailPasswordVariable = "UNICORNBOX_SMTP_PASSWORD"
+const mailFromVariable = "UNICORNBOX_MAIL_FROM"
+const mailDirVariable = "UNICORNBOX_MAIL_DIR"
+const siteURLVariable = "UNICORNBOX_URL"
+const defaultMailFrom = "UnicornBox <noreply@localhost>"
+
+// Administrators may act on other users' files, e.g. to transfer them
+// away from someone who left, and unlock accounts. They are listed,
+// separated by commas, in the environment variable adminUsersVariable.
+const adminUsersVariable = "UNICORNBOX_ADMINS"
+
+var adminUsers = map[string]bool{}
+
 const httpPort = 8080
 
 // The entry point for our server
@@ -31,6 +123,27 @@ func main() {
 	// so we need to re-create its tables.
 	createTables()
 
+	err := loadSigningKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	loadMailSender()
+	loadAdminUsers()
+	err = loadQuotaOverrides()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = loadCommonPasswords()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Clean up resumable uploads that were abandoned by their clients
+	go runPeriodically(uploadPurgeInterval, purgeExpiredUploads)
+
+	// Permanently delete files that have been in the trash for too long
+	go runPeriodically(trashPurgeInterval, purgeTrash)
+
 	mux := http.NewServeMux()
 
 	// Tell the HTTP server which request should be handled by what function
@@ -99,6 +212,115 @@ func setupRoutes(mux *http.ServeMux) {
 		}
 	})
 
+	mux.HandleFunc("/login/2fa", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username != "" {
+			showPage(response, "index", NewPageData(username, "Already logged in"))
+			return
+		}
+
+		switch request.Method {
+		case "POST":
+			processTwoFactorLogin(response, request)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/2fa", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Redirect(response, request, "/", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET":
+			handleTwoFactorRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/2fa/", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "POST":
+			handleTwoFactorRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/forgot", func(response http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case "GET":
+			showPasswordPage(response, "forgot", map[string]interface{}{})
+		case "POST":
+			requestPasswordReset(response, request)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/reset-password", func(response http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case "GET":
+			showPasswordReset(response, request)
+		case "POST":
+			resetPassword(response, request)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/account", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Redirect(response, request, "/", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET":
+			handleAccountRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/account/", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "POST":
+			handleAccountRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
 	mux.HandleFunc("/logout", func(response http.ResponseWriter, request *http.Request) {
 
 		switch request.Method {
@@ -113,7 +335,6 @@ func setupRoutes(mux *http.ServeMux) {
 
 	mux.HandleFunc("/upload", func(response http.ResponseWriter, request *http.Request) {
 		username := getUsernameFromCtx(request)
-		data := NewPageData(username, "")
 
 		if username == "" {
 			http.Error(response, "Not authorized", http.StatusUnauthorized)
@@ -122,7 +343,7 @@ func setupRoutes(mux *http.ServeMux) {
 
 		switch request.Method {
 		case "GET":
-			showPage(response, "upload", data)
+			showUploadPage(response, request, username)
 		case "POST":
 			processUpload(response, request, username)
 
@@ -132,6 +353,19 @@ func setupRoutes(mux *http.ServeMux) {
 
 	})
 
+	// Resumable uploads using the tus protocol
+	mux.HandleFunc("/uploads/", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		// OPTIONS lets clients discover the server's capabilities without logging in
+		if username == "" && request.Method != "OPTIONS" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		handleTusRequest(response, request, username)
+	})
+
 	mux.HandleFunc("/list", func(response http.ResponseWriter, request *http.Request) {
 		username := getUsernameFromCtx(request)
 
@@ -150,21 +384,330 @@ func setupRoutes(mux *http.ServeMux) {
 
 	})
 
+	mux.HandleFunc("/folders/", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "POST":
+			handleFolderRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
 	mux.HandleFunc("/file/", func(response http.ResponseWriter, request *http.Request) {
 		username := getUsernameFromCtx(request)
 
+		// signed download URLs work without a session
+		if isSignedDownload(request) {
+			var err error
+			username, err = verifySignedDownload(request)
+			if err != nil {
+				http.Error(response, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+
 		if username == "" {
 			http.Error(response, "Not authorized", http.StatusUnauthorized)
 			return
 		}
+
+		// /file/{id}/versions/... addresses the version history of a file
+		path := strings.Split(strings.TrimPrefix(request.URL.Path, "/file/"), "/")
+		if len(path) > 1 && path[1] == "versions" {
+			handleVersionRequest(response, request, username, path[0], path[2:])
+			return
+		}
+
+		// POST /file/{id}/{action} changes a file from the file list
+		if len(path) == 2 && request.Method == "POST" {
+			handleFileAction(response, request, username, path[0], path[1])
+			return
+		}
+
 		switch request.Method {
 		case "GET":
 			getFile(response, request, username)
+		case "DELETE":
+			deleteFile(response, request, username, path[0])
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+
+	})
+
+	mux.HandleFunc("/trash", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Redirect(response, request, "/", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET":
+			listTrash(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/trash/", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "POST":
+			handleTrashAction(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/links", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Redirect(response, request, "/", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET", "POST":
+			handleLinkRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/links/", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "POST":
+			handleLinkRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/requests", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Redirect(response, request, "/", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET", "POST":
+			handleFileRequestRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/requests/", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "POST":
+			handleFileRequestRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/groups", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Redirect(response, request, "/", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET", "POST":
+			handleGroupRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/groups/", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "POST":
+			handleGroupRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/download", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET", "POST":
+			downloadZip(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/inbox", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Redirect(response, request, "/", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET":
+			handleInboxRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/inbox/", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "POST":
+			handleInboxRequest(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/transfers", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Redirect(response, request, "/", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET":
+			listTransfers(response, request, username)
+		case "POST":
+			transferAllOwnership(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/lockouts", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Redirect(response, request, "/", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET":
+			listLockouts(response, request, username)
+		case "POST":
+			unlockAccount(response, request, username)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	// File requests work without logging in
+	mux.HandleFunc("/r/", func(response http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case "GET":
+			showFileRequestPage(response, request)
+		case "POST":
+			processFileRequestUpload(response, request)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
+	})
+
+	mux.HandleFunc("/notifications/clear", func(response http.ResponseWriter, request *http.Request) {
+		username := getUsernameFromCtx(request)
+
+		if username == "" {
+			http.Error(response, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "POST":
+			clearNotifications(response, request, username)
 
 		default:
 			resolveBadRequestMethod(response)
 		}
+	})
 
+	// Share links work without logging in
+	mux.HandleFunc("/s/", func(response http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case "GET", "POST":
+			getLinkedFile(response, request)
+
+		default:
+			resolveBadRequestMethod(response)
+		}
 	})
 
 	mux.HandleFunc("/share", func(response http.ResponseWriter, request *http.Request) {
@@ -0,0 +1,54 @@
+// Notifications shown to users on their file list, e.g. when someone
+// uploads a file through one of their file requests.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// notificationInfo helps you pass information about a notification to the template
+type notificationInfo struct {
+	Message string
+	Created time.Time
+}
+
+// Leave a message for the given user
+func notify(username, message string) error {
+	_, err := db.Exec("INSERT INTO notifications (username, message, created) VALUES (?, ?, ?)", username, message, time.Now().Unix())
+	return err
+}
+
+// Return the given user's notifications, newest first
+func listNotifications(username string) ([]notificationInfo, error) {
+	rows, err := db.Query("SELECT message, created FROM notifications WHERE username = ? ORDER BY created DESC, id DESC", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := make([]notificationInfo, 0)
+	for rows.Next() {
+		var notification notificationInfo
+		var created int64
+		err = rows.Scan(&notification.Message, &created)
+		if err != nil {
+			return nil, err
+		}
+		notification.Created = time.Unix(created, 0)
+		notifications = append(notifications, notification)
+	}
+	return notifications, rows.Err()
+}
+
+// Handle POST /notifications/clear: dismiss all of the user's notifications
+func clearNotifications(response http.ResponseWriter, request *http.Request, username string) {
+	_, err := db.Exec("DELETE FROM notifications WHERE username = ?", username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	http.Redirect(response, request, "/list", http.StatusFound)
+}
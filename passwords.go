@@ -0,0 +1,161 @@
+// Password hashing.
+//
+// Passwords are hashed with argon2id and stored in the PHC string format,
+// e.g. "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>", which carries the
+// salt and the parameters the hash was made with. Hashes are checked with
+// the parameters stored in them, so the configured ones can be raised
+// without breaking existing passwords; checkPassword replaces a user's
+// hash once they log in if it was made with weaker parameters.
+//
+// Hashes from before this format are a bare base64 argon2id hash with
+// fixed parameters and the salt in its own column. They are still
+// accepted, and always replaced on login.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2Params are the settings of an argon2id hash
+type argon2Params struct {
+	Time      uint32
+	Memory    uint32 // KiB
+	Threads   uint8
+	KeyLength uint32
+}
+
+// The parameters new hashes are made with
+var passwordHashParams = argon2Params{passwordHashTime, passwordHashMemory, passwordHashThreads, passwordHashKeyLength}
+
+// The fixed parameters of hashes from before the PHC format
+var legacyHashParams = argon2Params{1, 64 * 1024, 1, 32}
+
+// Return true if hashes made with params are weaker than ones made with other
+func (params argon2Params) weakerThan(other argon2Params) bool {
+	return params.Time < other.Time || params.Memory < other.Memory || params.Threads < other.Threads ||
+		params.KeyLength < other.KeyLength
+}
+
+// Hash a password with a new random salt, returning it in PHC format
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSizeBytes)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	params := passwordHashParams
+	hash := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// Split a PHC format argon2id hash into its parameters, salt and hash
+func parsePasswordHash(encoded string) (params argon2Params, salt, hash []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("unsupported password hash format")
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	if params.Time == 0 || params.Threads == 0 {
+		return params, nil, nil, errors.New("invalid argon2 parameters")
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	hash, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.KeyLength = uint32(len(hash))
+	return params, salt, hash, nil
+}
+
+// Return true if password matches a stored hash, and whether the hash
+// should be replaced by one made with the configured parameters.
+// legacySalt is the separately stored salt of hashes from before the PHC
+// format, and is ignored otherwise.
+func verifyPassword(password, encoded, legacySalt string) (correct, rehash bool, err error) {
+	var params argon2Params
+	var salt, hash []byte
+	if strings.HasPrefix(encoded, "$") {
+		params, salt, hash, err = parsePasswordHash(encoded)
+		if err != nil {
+			return false, false, err
+		}
+	} else {
+		params, salt = legacyHashParams, []byte(legacySalt)
+		hash, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return false, false, err
+		}
+		if uint32(len(hash)) != params.KeyLength {
+			return false, false, errors.New("unsupported password hash format")
+		}
+		// legacy hashes are always replaced, so they can be phased out
+		rehash = true
+	}
+
+	submitted := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	correct = subtle.ConstantTimeCompare(submitted, hash) == 1
+	rehash = correct && (rehash || params.weakerThan(passwordHashParams))
+	return correct, rehash, nil
+}
+
+// Return true if the given password is the user's password.
+// Returns sql.ErrNoRows if there is no such user.
+// The user's hash is upgraded if it was made with weaker parameters.
+func checkPassword(username, password string) (bool, error) {
+	row := db.QueryRow("SELECT password, salt FROM users WHERE username = ?", username)
+
+	// Parse database response: check for no response or get values
+	var encodedHash, salt string
+	err := row.Scan(&encodedHash, &salt)
+	if err == sql.ErrNoRows {
+		// take as long as for a real user, so timing doesn't reveal who exists
+		hashPassword(password)
+		return false, err
+	} else if err != nil {
+		return false, err
+	}
+
+	correct, rehash, err := verifyPassword(password, encodedHash, salt)
+	if err != nil || !correct {
+		return false, err
+	}
+
+	if rehash {
+		// failing to upgrade the hash doesn't stop the user logging in
+		newHash, err := hashPassword(password)
+		if err == nil {
+			// only if the password wasn't changed in the meantime
+			_, err = db.Exec("UPDATE users SET password = ?, salt = '' WHERE username = ? AND password = ?", newHash, username, encodedHash)
+		}
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Return a PHC format hash of password made with the given parameters
+func phcHash(password string, salt []byte, params argon2Params) string {
+	hash := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash))
+}
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	encoded, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, salt, hash, err := parsePasswordHash(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != passwordHashParams {
+		t.Errorf("parsed parameters %+v, want %+v", params, passwordHashParams)
+	}
+	if len(salt) != passwordSaltSizeBytes || len(hash) != passwordHashKeyLength {
+		t.Errorf("parsed %d byte salt and %d byte hash", len(salt), len(hash))
+	}
+
+	correct, rehash, err := verifyPassword("correct horse", encoded, "")
+	if err != nil || !correct || rehash {
+		t.Errorf("right password: correct %v, rehash %v, err %v", correct, rehash, err)
+	}
+	correct, rehash, err = verifyPassword("wrong horse", encoded, "")
+	if err != nil || correct || rehash {
+		t.Errorf("wrong password: correct %v, rehash %v, err %v", correct, rehash, err)
+	}
+}
+
+func TestVerifyLegacyPassword(t *testing.T) {
+	params := legacyHashParams
+	encoded := base64.StdEncoding.EncodeToString(argon2.IDKey([]byte("hunter22"), []byte("abcd1234"), params.Time, params.Memory, params.Threads, params.KeyLength))
+
+	correct, rehash, err := verifyPassword("hunter22", encoded, "abcd1234")
+	if err != nil || !correct || !rehash {
+		t.Errorf("right password: correct %v, rehash %v, err %v", correct, rehash, err)
+	}
+	correct, rehash, err = verifyPassword("hunter23", encoded, "abcd1234")
+	if err != nil || correct || rehash {
+		t.Errorf("wrong password: correct %v, rehash %v, err %v", correct, rehash, err)
+	}
+	correct, _, err = verifyPassword("hunter22", encoded, "otherSalt")
+	if err != nil || correct {
+		t.Errorf("wrong salt: correct %v, err %v", correct, err)
+	}
+}
+
+func TestVerifyRehashesWeakerParameters(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	weaker := []argon2Params{
+		{passwordHashParams.Time - 1, passwordHashParams.Memory, passwordHashParams.Threads, passwordHashParams.KeyLength},
+		{passwordHashParams.Time, passwordHashParams.Memory / 2, passwordHashParams.Threads, passwordHashParams.KeyLength},
+		{passwordHashParams.Time, passwordHashParams.Memory, passwordHashParams.Threads - 1, passwordHashParams.KeyLength},
+		{passwordHashParams.Time, passwordHashParams.Memory, passwordHashParams.Threads, passwordHashParams.KeyLength - 1},
+	}
+	for _, params := range weaker {
+		correct, rehash, err := verifyPassword("hunter22", phcHash("hunter22", salt, params), "")
+		if err != nil || !correct || !rehash {
+			t.Errorf("%+v: correct %v, rehash %v, err %v", params, correct, rehash, err)
+		}
+	}
+
+	stronger := passwordHashParams
+	stronger.Time++
+	correct, rehash, err := verifyPassword("hunter22", phcHash("hunter22", salt, stronger), "")
+	if err != nil || !correct || rehash {
+		t.Errorf("%+v: correct %v, rehash %v, err %v", stronger, correct, rehash, err)
+	}
+}
+
+func TestParseMalformedPasswordHash(t *testing.T) {
+	valid := phcHash("hunter22", []byte("0123456789abcdef"), argon2Params{1, 1024, 1, 32})
+	if _, _, _, err := parsePasswordHash(valid); err != nil {
+		t.Fatalf("valid hash %q: %v", valid, err)
+	}
+	parts := strings.Split(valid, "$")
+	salt, hash := parts[4], parts[5]
+
+	malformed := []string{
+		"",
+		"$",
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt,
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + hash + "$",
+		"argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + hash + "$",
+		"$argon2i$v=19$m=1024,t=1,p=1$" + salt + "$" + hash,
+		"$argon2id$v=16$m=1024,t=1,p=1$" + salt + "$" + hash,
+		"$argon2id$19$m=1024,t=1,p=1$" + salt + "$" + hash,
+		"$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + hash,
+		"$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + hash,
+		"$argon2id$v=19$m=1024,t=1,p=256$" + salt + "$" + hash,
+		"$argon2id$v=19$m=x,t=1,p=1$" + salt + "$" + hash,
+		"$argon2id$v=19$t=1,m=1024,p=1$" + salt + "$" + hash,
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "!$" + hash,
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + hash + "==",
+	}
+	for _, encoded := range malformed {
+		if _, _, _, err := parsePasswordHash(encoded); err == nil {
+			t.Errorf("parsed malformed hash %q", encoded)
+		}
+		if correct, _, err := verifyPassword("hunter22", encoded, ""); err == nil || correct {
+			t.Errorf("verified malformed hash %q: correct %v, err %v", encoded, correct, err)
+		}
+	}
+}
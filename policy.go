@@ -0,0 +1,64 @@
+// Rules for usernames and passwords.
+//
+// Passwords must be at least minPasswordLength characters long, differ
+// from the username, and not be in the list of common passwords in
+// commonPasswordsPath. Usernames must match usernamePattern. The errors
+// are meant to be shown to people as they are.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var usernameRegexp = regexp.MustCompile(usernamePattern)
+
+// Lowercased passwords that are too common to be allowed
+var commonPasswords = map[string]bool{}
+
+// Load the list of common passwords, one per line. Lines starting with #
+// are comments.
+func loadCommonPasswords() error {
+	file, err := os.Open(commonPasswordsPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commonPasswords[strings.ToLower(line)] = true
+	}
+	return scanner.Err()
+}
+
+// Return an error describing why a username can't be used, or nil if it can
+func checkUsernamePolicy(username string) error {
+	if !usernameRegexp.MatchString(username) {
+		return errors.New(usernameRules)
+	}
+	return nil
+}
+
+// Return an error describing why a password can't be used by the given
+// user, or nil if it can
+func checkPasswordPolicy(username, password string) error {
+	if len([]rune(password)) < minPasswordLength {
+		return fmt.Errorf("Passwords must be at least %d characters long.", minPasswordLength)
+	}
+	if strings.EqualFold(password, username) {
+		return errors.New("Your password can't be the same as your username.")
+	}
+	if commonPasswords[strings.ToLower(password)] {
+		return errors.New("That password is too common, please choose another one.")
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Per-user storage quotas.
+//
+// The storage_usage table keeps a running total of the bytes each user owns,
+// counting every version of every file, including files in the trash.
+// Uploads are charged when they are recorded and the space is given back
+// when a file is purged.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// Serializes quota checks with the charges that follow them
+var quotaLock sync.Mutex
+
+// Units of sizes in quota overrides, in the same binary sense as formatBytes
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1 << 10,
+	"KIB": 1 << 10,
+	"MB":  1 << 20,
+	"MIB": 1 << 20,
+	"GB":  1 << 30,
+	"GIB": 1 << 30,
+	"TB":  1 << 40,
+	"TIB": 1 << 40,
+}
+
+// Parse a size like "512MB" or "20GiB" into a number of bytes
+func parseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	digits := strings.TrimRightFunc(value, unicode.IsLetter)
+	unit, ok := sizeUnits[strings.ToUpper(value[len(digits):])]
+	number, err := strconv.ParseInt(strings.TrimSpace(digits), 10, 64)
+	if !ok || err != nil || number < 0 || number > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return number * unit, nil
+}
+
+// Load the quota overrides from the comma-separated list of
+// username=size pairs in the environment variable named by
+// quotaOverridesVariable
+func loadQuotaOverrides() error {
+	value := os.Getenv(quotaOverridesVariable)
+	if value == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		username := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || username == "" {
+			return fmt.Errorf("%s: expected username=size, got %q", quotaOverridesVariable, entry)
+		}
+		size, err := parseSize(parts[1])
+		if err != nil {
+			return fmt.Errorf("%s: %v", quotaOverridesVariable, err)
+		}
+		quotaOverrides[username] = size
+	}
+	return nil
+}
+
+// Return the number of bytes the given user may store
+func userQuota(username string) int64 {
+	if quota, ok := quotaOverrides[username]; ok {
+		return quota
+	}
+	return defaultQuota
+}
+
+// Return the number of bytes currently charged to the given user
+func quotaUsed(username string) (int64, error) {
+	var used int64
+	err := db.QueryRow("SELECT bytes FROM storage_usage WHERE username = ?", username).Scan(&used)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return used, err
+}
+
+// Return how many more bytes the given user may store
+func quotaRemaining(username string) (int64, error) {
+	used, err := quotaUsed(username)
+	if err != nil {
+		return 0, err
+	}
+	remaining := userQuota(username) - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, nil
+}
+
+// Charge size bytes to the given user, unless that would exceed their quota
+func reserveQuota(username string, size int64) error {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	return chargeQuota(db, username, size)
+}
+
+// Charge size bytes to the given user through q, unless that would exceed
+// their quota. The caller must hold quotaLock.
+func chargeQuota(q dbQuerier, username string, size int64) error {
+	var used int64
+	err := q.QueryRow("SELECT IFNULL((SELECT bytes FROM storage_usage WHERE username = ?), 0)", username).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used+size > userQuota(username) {
+		return errQuotaExceeded
+	}
+	return addQuotaUsed(q, username, size)
+}
+
+// Give size bytes back to the given user
+func releaseQuota(username string, size int64) error {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	return addQuotaUsed(db, username, -size)
+}
+
+// Adjust the bytes charged to the given user through q. The caller must
+// hold quotaLock.
+func addQuotaUsed(q dbQuerier, username string, delta int64) error {
+	_, err := q.Exec("INSERT OR IGNORE INTO storage_usage (username, bytes) VALUES (?, 0)", username)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("UPDATE storage_usage SET bytes = bytes + ? WHERE username = ?", delta, username)
+	return err
+}
+
+// Return a message describing a user's quota, for rejected uploads
+func quotaExceededMessage(username string) string {
+	used, _ := quotaUsed(username)
+	return fmt.Sprintf("%s: using %s of %s", errQuotaExceeded, formatBytes(used), formatBytes(userQuota(username)))
+}
+
+// quotaReader fails with errQuotaExceeded once more than remaining bytes
+// have been read from it, so an upload stops as soon as it goes over quota
+type quotaReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.reader.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
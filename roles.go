@@ -0,0 +1,159 @@
+// Permission levels for shared files and folders.
+//
+// Every row of the files table carries the role its user has on the file:
+// the owner's own row has roleOwner, shared copies one of the share roles.
+// Folder shares and shares with groups carry a role as well; a folder's role
+// applies to everything inside it. When a user has several roles on a file,
+// the strongest wins.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+const (
+	roleViewer  = "viewer"  // may download the file
+	roleEditor  = "editor"  // may also upload new versions
+	roleCoOwner = "coowner" // may also share the file and revoke shares
+	roleOwner   = "owner"
+)
+
+// Strength of each role; a role includes the permissions of every weaker one
+var roleRanks = map[string]int{
+	roleViewer:  1,
+	roleEditor:  2,
+	roleCoOwner: 3,
+	roleOwner:   4,
+}
+
+// Return true if role grants at least the permissions of minimum
+func roleAtLeast(role, minimum string) bool {
+	return role != "" && roleRanks[role] >= roleRanks[minimum]
+}
+
+// Return the stronger of two roles
+func strongerRole(a, b string) string {
+	if roleRanks[b] > roleRanks[a] {
+		return b
+	}
+	return a
+}
+
+// Return true if role may be given to someone when sharing
+func validShareRole(role string) bool {
+	return role == roleViewer || role == roleEditor || role == roleCoOwner
+}
+
+// Return the strongest of the roles selected by a query, or "" if it
+// selects none
+func strongestRole(query string, args ...interface{}) (string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	role := ""
+	for rows.Next() {
+		var found string
+		err = rows.Scan(&found)
+		if err != nil {
+			return "", err
+		}
+		role = strongerRole(role, found)
+	}
+	return role, rows.Err()
+}
+
+// Return the role the given user has on a folder through the folder itself
+// or one of the folders containing it, shared with them directly or with
+// one of their groups, or "" if they have no access
+func folderRole(username, folderID string) (string, error) {
+	path, err := folderAncestors(folderID)
+	if err == sql.ErrNoRows || len(path) == 0 {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if path[0].Owner == username {
+		return roleOwner, nil
+	}
+
+	role := ""
+	for _, folder := range path {
+		shareRole, err := strongestRole(`SELECT role FROM folder_shares WHERE folder_id = ? AND username = ? AND pending = 0
+			UNION SELECT folder_group_shares.role FROM folder_group_shares
+			JOIN group_members ON group_members.group_id = folder_group_shares.group_id
+			WHERE folder_group_shares.folder_id = ? AND group_members.username = ? AND group_members.pending = 0`, folder.ID, username, folder.ID, username)
+		if err != nil {
+			return "", err
+		}
+		role = strongerRole(role, shareRole)
+	}
+	return role, nil
+}
+
+// Return the role the given user has on a file, either from their own row
+// in the files table, from a share with one of their groups, or from a
+// folder shared with them, or "" if they have no access
+func fileRole(username, objectID string) (string, error) {
+	role, err := strongestRole(`SELECT role FROM files WHERE username = ? AND object_id = ? AND pending = 0
+		UNION SELECT file_group_shares.role FROM file_group_shares
+		JOIN group_members ON group_members.group_id = file_group_shares.group_id
+		JOIN files ON files.object_id = file_group_shares.object_id AND files.username = files.owner
+		WHERE file_group_shares.object_id = ? AND group_members.username = ? AND group_members.pending = 0`, username, objectID, objectID, username)
+	if err != nil {
+		return "", err
+	}
+
+	folderID, err := fileFolder(objectID)
+	if err == sql.ErrNoRows || folderID == "" {
+		return role, nil
+	} else if err != nil {
+		return "", err
+	}
+	inherited, err := folderRole(username, folderID)
+	if err != nil {
+		return "", err
+	}
+	return strongerRole(role, inherited), nil
+}
+
+// Look up a folder the given user may share with others, or revoke shares of.
+// Writes an error response and returns false if they are not a co-owner.
+func checkFolderSharer(response http.ResponseWriter, username, folderID string) (folder folderInfo, ok bool) {
+	role, err := folderRole(username, folderID)
+	if err == nil && roleAtLeast(role, roleCoOwner) {
+		folder, err = lookupFolder(folderID)
+		if err == nil {
+			return folder, true
+		}
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return folder, false
+	}
+	response.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(response, "not authorized to share folder")
+	return folder, false
+}
+
+// Check that the given user may share a file with others, or revoke shares of it.
+// Writes an error response and returns false if they are not a co-owner.
+func checkFileSharer(response http.ResponseWriter, username, objectID string) bool {
+	role, err := fileRole(username, objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return false
+	}
+	if !roleAtLeast(role, roleCoOwner) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to share file")
+		return false
+	}
+	return true
+}
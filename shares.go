@@ -0,0 +1,177 @@
+// Managing who files and folders are shared with.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// shareInfo helps you pass information about something the user shared to the template
+type shareInfo struct {
+	ID         string
+	Name       string
+	IsFolder   bool
+	Recipients []recipientInfo
+}
+
+// recipientInfo is someone a file or folder is shared with, and their role
+type recipientInfo struct {
+	Name    string // a username, or a group name if IsGroup is set
+	Role    string
+	IsGroup bool
+	Pending bool // the recipient hasn't accepted the share yet
+}
+
+// Return everything the given user owns and has shared with others, along with the
+// recipients of each: folders first, then files
+func listSharedByMe(username string) ([]shareInfo, error) {
+	shares := make([]shareInfo, 0)
+
+	rows, err := db.Query(`SELECT folders.id, folders.name, folder_shares.username, folder_shares.role, 0, folder_shares.pending FROM folder_shares
+		JOIN folders ON folders.id = folder_shares.folder_id WHERE folder_shares.owner = ?
+		UNION ALL SELECT folders.id, folders.name, user_groups.name, folder_group_shares.role, 1, 0 FROM folder_group_shares
+		JOIN folders ON folders.id = folder_group_shares.folder_id
+		JOIN user_groups ON user_groups.id = folder_group_shares.group_id WHERE folder_group_shares.owner = ?
+		ORDER BY 2, 1, 5, 3`, username, username)
+	if err != nil {
+		return nil, err
+	}
+	shares, err = groupShares(rows, shares, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT object_id, filename, username, role, 0, pending FROM files WHERE owner = ? AND username != owner
+		UNION ALL SELECT files.object_id, files.filename, user_groups.name, file_group_shares.role, 1, 0 FROM file_group_shares
+		JOIN files ON files.object_id = file_group_shares.object_id AND files.username = files.owner
+		JOIN user_groups ON user_groups.id = file_group_shares.group_id WHERE files.owner = ?
+		ORDER BY 2, 1, 5, 3`, username, username)
+	if err != nil {
+		return nil, err
+	}
+	return groupShares(rows, shares, false)
+}
+
+// Append the rows of a query selecting an ID, a name, a recipient, their role,
+// whether the recipient is a group and whether the share is pending to
+// shares, combining consecutive rows with the same ID into one entry
+func groupShares(rows *sql.Rows, shares []shareInfo, isFolder bool) ([]shareInfo, error) {
+	defer rows.Close()
+
+	first := len(shares)
+	for rows.Next() {
+		var id, name string
+		var recipient recipientInfo
+		err := rows.Scan(&id, &name, &recipient.Name, &recipient.Role, &recipient.IsGroup, &recipient.Pending)
+		if err != nil {
+			return nil, err
+		}
+		if len(shares) == first || shares[len(shares)-1].ID != id {
+			shares = append(shares, shareInfo{ID: id, Name: name, IsFolder: isFolder})
+		}
+		last := &shares[len(shares)-1]
+		last.Recipients = append(last.Recipients, recipient)
+	}
+	return shares, rows.Err()
+}
+
+// Take away a recipient's access to a file shared with them
+func revokeFileShare(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	recipient := request.FormValue("username")
+
+	ok := checkFileSharer(response, username, objectID)
+	if !ok {
+		return
+	}
+
+	if groupName := request.FormValue("group"); groupName != "" {
+		group, ok := checkGroupName(response, groupName)
+		if !ok {
+			return
+		}
+		revokeGroupShare(response, request, "DELETE FROM file_group_shares WHERE object_id = ? AND group_id = ?", objectID, group)
+		return
+	}
+
+	digests, err := queryDigests(db, "SELECT digest FROM files WHERE object_id = ? AND username = ? AND username != owner", objectID, recipient)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if len(digests) == 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "file is not shared with %s", recipient)
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM files WHERE object_id = ? AND username = ? AND username != owner", objectID, recipient)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	// the recipient's rows no longer refer to the contents
+	for _, digest := range digests {
+		err = releaseBlob(digest)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+	}
+
+	http.Redirect(response, request, "/list", http.StatusFound)
+}
+
+// Take away a recipient's access to a folder shared with them
+func revokeFolderShare(response http.ResponseWriter, request *http.Request, username, folderID string) {
+	recipient := request.FormValue("username")
+
+	_, ok := checkFolderSharer(response, username, folderID)
+	if !ok {
+		return
+	}
+
+	if groupName := request.FormValue("group"); groupName != "" {
+		group, ok := checkGroupName(response, groupName)
+		if !ok {
+			return
+		}
+		revokeGroupShare(response, request, "DELETE FROM folder_group_shares WHERE folder_id = ? AND group_id = ?", folderID, group)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM folder_shares WHERE folder_id = ? AND username = ?", folderID, recipient)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "folder is not shared with %s", recipient)
+		return
+	}
+
+	http.Redirect(response, request, "/list", http.StatusFound)
+}
+
+// Take away a group's access to a file or folder, using a statement that
+// deletes the share of the given item with the given group ID
+func revokeGroupShare(response http.ResponseWriter, request *http.Request, statement, itemID string, group groupInfo) {
+	result, err := db.Exec(statement, itemID, group.ID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "not shared with group %s", group.Name)
+		return
+	}
+
+	http.Redirect(response, request, "/list", http.StatusFound)
+}
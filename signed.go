@@ -0,0 +1,140 @@
+// Signed download URLs.
+//
+// A signed URL lets a script download a file without a session cookie:
+// GET /file/{id}?user=...&expires=...&signature=... is handled as if that
+// user had requested the file, until the expiry time. The signature is an
+// HMAC over the file ID, the expiry time and the user, so none of them can
+// be changed. The user still needs access to the file when the URL is used.
+//
+// URLs are signed with the first key in signingKeys, and accepted if any
+// of the keys verifies them. To rotate keys, put a new key in front of the
+// list; removing a key invalidates every URL that was signed with it.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Keys that download URLs are signed with, newest first
+var signingKeys [][]byte
+
+// Load the signing keys from the comma-separated list in the environment
+// variable named by signingKeysVariable. Without it a random key is used,
+// so signed URLs stop working when the server restarts.
+func loadSigningKeys() error {
+	value := os.Getenv(signingKeysVariable)
+	if value == "" {
+		key, err := randomByteString(32)
+		if err != nil {
+			return err
+		}
+		log.Warnf("%s is not set, signed download URLs will not survive a restart", signingKeysVariable)
+		signingKeys = [][]byte{[]byte(key)}
+		return nil
+	}
+
+	signingKeys = nil
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if len(key) < 32 {
+			return fmt.Errorf("%s: signing keys must be at least 32 characters long", signingKeysVariable)
+		}
+		signingKeys = append(signingKeys, []byte(key))
+	}
+	return nil
+}
+
+// Return the signature of a download URL for the given file, user and expiry time
+func signDownload(key []byte, objectID, username string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	// newlines can't appear in file IDs or usernames, so fields can't run together
+	fmt.Fprintf(mac, "%s\n%d\n%s", objectID, expires, username)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return a URL path that downloads a file as the given user until expires
+func signedDownloadURL(objectID, username string, expires time.Time) string {
+	query := url.Values{}
+	query.Set("user", username)
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", signDownload(signingKeys[0], objectID, username, expires.Unix()))
+	return "/file/" + objectID + "?" + query.Encode()
+}
+
+// Return true if a request carries a signature, meaning it should be
+// authorized by verifySignedDownload instead of its session
+func isSignedDownload(request *http.Request) bool {
+	return request.Method == "GET" && request.URL.Query().Get("signature") != ""
+}
+
+// Check the signature of a download URL, returning the user it was signed for
+func verifySignedDownload(request *http.Request) (username string, err error) {
+	objectID := strings.TrimPrefix(request.URL.Path, "/file/")
+	if strings.Contains(objectID, "/") {
+		return "", errors.New("only file downloads can be signed")
+	}
+
+	query := request.URL.Query()
+	username = query.Get("user")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return "", errors.New("invalid expiry time")
+	}
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return "", errors.New("invalid signature")
+	}
+
+	for _, key := range signingKeys {
+		expected, _ := hex.DecodeString(signDownload(key, objectID, username, expires))
+		if hmac.Equal(signature, expected) {
+			if time.Now().Unix() >= expires {
+				return "", errors.New("download URL has expired")
+			}
+			return username, nil
+		}
+	}
+	return "", errors.New("invalid signature")
+}
+
+// Handle POST /file/{id}/sign: respond with a signed URL downloading the
+// file as the requesting user. The optional form value expires_in gives
+// its lifetime in seconds, up to signedURLMaxDuration.
+func signFile(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	duration := signedURLDuration
+	if value := request.FormValue("expires_in"); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > signedURLMaxDuration {
+			response.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(response, "expires_in must be between 1 and %d seconds", int64(signedURLMaxDuration/time.Second))
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	role, err := fileRole(username, objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if role == "" {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to download")
+		return
+	}
+
+	fmt.Fprint(response, signedDownloadURL(objectID, username, time.Now().Add(duration)))
+}
@@ -0,0 +1,162 @@
+// On-disk storage for uploaded files.
+//
+// File contents live in a content-addressed blob store: each distinct
+// content is written once under its SHA-256 digest, and the blobs table
+// counts how many rows of the files table refer to it. A blob is removed
+// from disk once the last reference to it is released.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Size of a stored object's identifier, in random bytes
+const objectIDSizeBytes = 16
+
+// Serializes changes to the blob store, so that a blob can't be garbage
+// collected while another request is adding a reference to it
+var blobLock sync.Mutex
+
+// Return a new, unguessable identifier for a stored object.
+// Objects are never named after the client's filename, so two uploads
+// with the same name can't overwrite each other.
+func newObjectID() (string, error) {
+	return randomByteString(objectIDSizeBytes)
+}
+
+// Return the on-disk location of the blob with the given digest
+func blobPath(digest string) string {
+	return filepath.Join(filePath, digest)
+}
+
+// Work out the MIME type of a stored blob by sniffing its first bytes,
+// falling back to the file name's extension if that is inconclusive
+func detectContentType(filename, digest string) string {
+	const fallback = "application/octet-stream"
+
+	contentType := fallback
+	blob, err := os.Open(blobPath(digest))
+	if err == nil {
+		// http.DetectContentType considers at most the first 512 bytes
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(blob, head)
+		blob.Close()
+		contentType = http.DetectContentType(head[:n])
+	}
+
+	if contentType == fallback {
+		if byExtension := mime.TypeByExtension(filepath.Ext(filename)); byExtension != "" {
+			contentType = byExtension
+		}
+	}
+	return contentType
+}
+
+// Stream contents from r into a temporary file next to the blob store,
+// hashing them along the way. The temporary file is removed if reading
+// fails, e.g. because the client disconnected or the body was too large.
+func stageBlob(r io.Reader) (tmpPath, digest string, size int64, err error) {
+	tmpFile, err := ioutil.TempFile(filePath, "upload-*.tmp")
+	if err != nil {
+		return "", "", 0, err
+	}
+	tmpPath = tmpFile.Name()
+
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmpFile, hash), r)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", "", 0, err
+	}
+	return tmpPath, hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// Move a staged temporary file into the blob store and take a reference to it.
+// If an identical blob already exists the temporary file is discarded instead.
+func commitBlob(tmpPath, digest string, size int64) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	if fileExists(blobPath(digest)) {
+		os.Remove(tmpPath)
+	} else {
+		// rename is atomic, so a partially written blob is never visible
+		// under its digest
+		err := os.Rename(tmpPath, blobPath(digest))
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	_, err := db.Exec("INSERT OR IGNORE INTO blobs (digest, size, refcount) VALUES (?, ?, 0)", digest, size)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE blobs SET refcount = refcount + 1 WHERE digest = ?", digest)
+	return err
+}
+
+// Store the contents read from r in the blob store and take a reference to them.
+// Returns the digest identifying the blob and the number of bytes stored.
+func storeBlob(r io.Reader) (digest string, size int64, err error) {
+	tmpPath, digest, size, err := stageBlob(r)
+	if err != nil {
+		return "", 0, err
+	}
+	err = commitBlob(tmpPath, digest, size)
+	if err != nil {
+		return "", 0, err
+	}
+	return digest, size, nil
+}
+
+// Take an additional reference to an existing blob
+func retainBlob(digest string) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	_, err := db.Exec("UPDATE blobs SET refcount = refcount + 1 WHERE digest = ?", digest)
+	return err
+}
+
+// Drop a reference to a blob, deleting it once nothing refers to it anymore
+func releaseBlob(digest string) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	_, err := db.Exec("UPDATE blobs SET refcount = refcount - 1 WHERE digest = ?", digest)
+	if err != nil {
+		return err
+	}
+
+	var refcount int
+	err = db.QueryRow("SELECT refcount FROM blobs WHERE digest = ?", digest).Scan(&refcount)
+	if err != nil {
+		return err
+	}
+	if refcount > 0 {
+		return nil
+	}
+
+	_, err = db.Exec("DELETE FROM blobs WHERE digest = ?", digest)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(blobPath(digest))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+// Throttling of login attempts.
+//
+// Failed logins are counted per account and per client IP address. After
+// a few free attempts, each failure makes the next attempt wait twice as
+// long as the one before, and enough failures lock the account or address
+// out for loginLockoutDuration. Counts are forgotten once there have been
+// no attempts for loginLockoutDuration, and an account's count is cleared
+// when its user logs in. Administrators can unlock accounts from /lockouts.
+//
+// Accounts are counted by the submitted username whether or not it exists,
+// so the throttling doesn't tell anyone which usernames are taken.
+//
+// Wrong passwords for share links are throttled the same way, counted per
+// link and per address, with the addresses counting towards the same
+// limit as their logins.
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loginThrottle counts failed login attempts by one kind of key
+type loginThrottle struct {
+	Kind            string
+	FreeAttempts    int
+	LockoutFailures int
+}
+
+var accountThrottle = loginThrottle{"account", freeAccountLoginAttempts, accountLockoutFailures}
+var addressThrottle = loginThrottle{"address", freeAddressLoginAttempts, addressLockoutFailures}
+var linkThrottle = loginThrottle{"link", freeLinkPasswordAttempts, linkLockoutFailures}
+
+// lockoutInfo helps you pass information about a throttled account to the template
+type lockoutInfo struct {
+	Username     string
+	Failures     int
+	BlockedUntil time.Time
+}
+
+// Return how long to block attempts after the given number of failures
+func (throttle loginThrottle) delay(failures int) time.Duration {
+	if failures >= throttle.LockoutFailures {
+		return loginLockoutDuration
+	}
+	if failures < throttle.FreeAttempts {
+		return 0
+	}
+	delay := loginBackoffBase
+	for i := throttle.FreeAttempts; i < failures && delay < loginBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > loginBackoffMax {
+		delay = loginBackoffMax
+	}
+	return delay
+}
+
+// Count a login attempt for key in advance, as if it were going to fail.
+// Returns how long to wait instead if the key is blocked. Claiming an
+// attempt and checking the block happen together, so clients can't get
+// around the backoff by sending many attempts at once.
+func (throttle loginThrottle) claim(key string) (wait time.Duration, err error) {
+	_, err = db.Exec("INSERT OR IGNORE INTO login_throttle (kind, name, failures, last_attempt, blocked_until) VALUES (?, ?, 0, 0, 0)", throttle.Kind, key)
+	if err != nil {
+		return 0, err
+	}
+
+	var failures int
+	var lastAttempt, blockedUntil int64
+	row := db.QueryRow("SELECT failures, last_attempt, blocked_until FROM login_throttle WHERE kind = ? AND name = ?", throttle.Kind, key)
+	err = row.Scan(&failures, &lastAttempt, &blockedUntil)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	if now.Unix() < blockedUntil {
+		return time.Unix(blockedUntil, 0).Sub(now), nil
+	}
+	count := failures
+	if now.Sub(time.Unix(lastAttempt, 0)) > loginLockoutDuration {
+		count = 0
+	}
+	count++
+
+	// if another attempt got in first, this one has to wait for it
+	result, err := db.Exec(`UPDATE login_throttle SET failures = ?, last_attempt = ?, blocked_until = ?
+		WHERE kind = ? AND name = ? AND failures = ? AND last_attempt = ?`,
+		count, now.Unix(), now.Add(throttle.delay(count)).Unix(), throttle.Kind, key, failures, lastAttempt)
+	if err != nil {
+		return 0, err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return loginBackoffBase, nil
+	}
+	return 0, nil
+}
+
+// Take back an attempt claimed for key, because it succeeded
+func (throttle loginThrottle) release(key string) error {
+	_, err := db.Exec("UPDATE login_throttle SET failures = MAX(failures - 1, 0), blocked_until = 0 WHERE kind = ? AND name = ?", throttle.Kind, key)
+	return err
+}
+
+// Forget every failed attempt for key
+func (throttle loginThrottle) reset(key string) error {
+	_, err := db.Exec("DELETE FROM login_throttle WHERE kind = ? AND name = ?", throttle.Kind, key)
+	return err
+}
+
+// Return the address a request came from, without its port
+func clientAddress(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// Claim a login attempt for a username from the client making the request.
+// Writes an error response and returns false if either one is blocked.
+func claimLoginAttempt(response http.ResponseWriter, request *http.Request, username string) bool {
+	return claimAttempt(response, request, accountThrottle, username)
+}
+
+// Claim an attempt at a password for key, counted by throttle, from the
+// client making the request.
+// Writes an error response and returns false if either one is blocked.
+func claimAttempt(response http.ResponseWriter, request *http.Request, throttle loginThrottle, key string) bool {
+	wait, err := addressThrottle.claim(clientAddress(request))
+	if err == nil && wait == 0 {
+		wait, err = throttle.claim(key)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return false
+	}
+	if wait > 0 {
+		seconds := int64((wait + time.Second - 1) / time.Second)
+		response.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+		response.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(response, "too many failed attempts, try again later")
+		return false
+	}
+	return true
+}
+
+// Clear the counters of a login that succeeded
+func loginSucceeded(request *http.Request, username string) {
+	attemptSucceeded(request, accountThrottle, username)
+}
+
+// Clear the counters of an attempt at a password for key that succeeded
+func attemptSucceeded(request *http.Request, throttle loginThrottle, key string) {
+	err := addressThrottle.release(clientAddress(request))
+	if err == nil {
+		err = throttle.reset(key)
+	}
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Respond to a failed login the same way whatever went wrong, so the
+// response doesn't tell whether the username exists
+func loginFailed(response http.ResponseWriter) {
+	response.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprint(response, "incorrect username or password")
+}
+
+// Handle GET /lockouts: show administrators the accounts with failed logins
+func listLockouts(response http.ResponseWriter, request *http.Request, username string) {
+	if !isAdmin(username) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to see lockouts")
+		return
+	}
+
+	rows, err := db.Query(`SELECT name, failures, blocked_until FROM login_throttle
+		WHERE kind = ? AND failures > 0 AND last_attempt > ? ORDER BY blocked_until DESC, name`,
+		accountThrottle.Kind, time.Now().Add(-loginLockoutDuration).Unix())
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	lockouts := make([]lockoutInfo, 0)
+	for rows.Next() {
+		var lockout lockoutInfo
+		var blockedUntil int64
+		err = rows.Scan(&lockout.Username, &lockout.Failures, &blockedUntil)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		if blockedUntil > time.Now().Unix() {
+			lockout.BlockedUntil = time.Unix(blockedUntil, 0)
+		}
+		lockouts = append(lockouts, lockout)
+	}
+
+	data := map[string]interface{}{
+		"Username": username,
+		"Lockouts": lockouts,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/lockouts.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Handle POST /lockouts: let administrators unlock the account given by
+// the form value username
+func unlockAccount(response http.ResponseWriter, request *http.Request, username string) {
+	if !isAdmin(username) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to unlock accounts")
+		return
+	}
+
+	err := accountThrottle.reset(request.FormValue("username"))
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/lockouts", http.StatusFound)
+}
@@ -0,0 +1,629 @@
+// Transferring ownership of files and folders to another user.
+//
+// A transfer rewrites the owner of a single file, of a folder with
+// everything inside it, or of all of a user's files. Everyone the files
+// were shared with keeps their access, and the space the files take up is
+// charged to the new owner instead of the old one. Transferred files and
+// folders land at the new owner's top level, renamed if the new owner
+// already has something of the same name there. Every transfer is recorded
+// in the transfers table.
+//
+// Owners may offer their own files to someone else. The offer waits in the
+// recipient's inbox, and nothing changes hands or is charged to their
+// quota until they accept it, unless they accept invitations from the
+// owner automatically. Administrators may transfer anyone's files, which
+// happens straight away.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// transferInfo helps you pass information about a past transfer to the template
+type transferInfo struct {
+	Kind     string // "file", "folder" or "all"
+	Name     string
+	From     string
+	To       string
+	By       string
+	Occurred time.Time
+}
+
+// Return the IDs of a folder and every folder inside it
+func folderTree(q dbQuerier, folderID string) ([]string, error) {
+	tree := []string{folderID}
+	for i := 0; i < len(tree); i++ {
+		children, err := queryObjectIDs(q, "SELECT id FROM folders WHERE parent_id = ?", tree[i])
+		if err != nil {
+			return nil, err
+		}
+		tree = append(tree, children...)
+	}
+	return tree, nil
+}
+
+// Return the IDs selected by a query
+func queryObjectIDs(q dbQuerier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objectIDs []string
+	for rows.Next() {
+		var objectID string
+		err = rows.Scan(&objectID)
+		if err != nil {
+			return nil, err
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+	return objectIDs, rows.Err()
+}
+
+// Return the number of bytes charged for the given files: every version counts
+func transferSize(q dbQuerier, objectIDs []string) (int64, error) {
+	var total int64
+	for _, objectID := range objectIDs {
+		var size int64
+		err := q.QueryRow("SELECT IFNULL(SUM(size), 0) FROM versions WHERE object_id = ?", objectID).Scan(&size)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// Return a name for a folder that none of the owner's folders in the
+// parent has yet
+func uniqueFolderName(q dbQuerier, owner, parentID, name string) (string, error) {
+	candidate := name
+	for i := 2; ; i++ {
+		var count int
+		row := q.QueryRow("SELECT COUNT(*) FROM folders WHERE owner = ? AND parent_id = ? AND name = ?", owner, parentID, candidate)
+		err := row.Scan(&count)
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		candidate = name + strconv.Itoa(i)
+	}
+}
+
+// Make a user the owner of a file, keeping everyone it is shared with.
+// Files moved to the top level get a name the new owner doesn't use there
+// yet; files inside a transferred folder stay where they are.
+// Returns the blobs of the new owner's shared copy, which the caller must
+// release once the transfer is committed.
+func transferFile(q dbQuerier, objectID, to string, toTopLevel bool) (released []string, err error) {
+	// the new owner no longer needs their shared copy
+	released, err = queryDigests(q, "SELECT digest FROM files WHERE object_id = ? AND username = ? AND username != owner", objectID, to)
+	if err != nil {
+		return nil, err
+	}
+	_, err = q.Exec("DELETE FROM files WHERE object_id = ? AND username = ? AND username != owner", objectID, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var filename, folderID string
+	err = q.QueryRow("SELECT filename, folder_id FROM files WHERE object_id = ? AND username = owner", objectID).Scan(&filename, &folderID)
+	if err != nil {
+		return nil, err
+	}
+	if toTopLevel {
+		folderID = ""
+		filename, err = uniqueFilename(q, to, "", filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = q.Exec(`UPDATE files SET username = CASE WHEN username = owner THEN ? ELSE username END,
+		owner = ?, filename = ?, folder_id = ? WHERE object_id = ?`, to, to, filename, folderID, objectID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = q.Exec("UPDATE file_group_shares SET owner = ? WHERE object_id = ?", to, objectID)
+	return released, err
+}
+
+// Make a user the owner of a folder and of every folder and file inside it,
+// moving it to the new owner's top level. Returns the blobs to release, as
+// transferFile does.
+func transferFolder(q dbQuerier, folderID, to string, tree []string) (released []string, err error) {
+	var folderName string
+	err = q.QueryRow("SELECT name FROM folders WHERE id = ?", folderID).Scan(&folderName)
+	if err != nil {
+		return nil, err
+	}
+	name, err := uniqueFolderName(q, to, "", folderName)
+	if err != nil {
+		return nil, err
+	}
+	_, err = q.Exec("UPDATE folders SET parent_id = '', name = ? WHERE id = ?", name, folderID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range tree {
+		statements := []string{
+			"UPDATE folders SET owner = ? WHERE id = ?",
+			// the new owner no longer needs the folder shared with them
+			"DELETE FROM folder_shares WHERE username = ? AND folder_id = ?",
+			"UPDATE folder_shares SET owner = ? WHERE folder_id = ?",
+			"UPDATE folder_group_shares SET owner = ? WHERE folder_id = ?",
+			"UPDATE file_requests SET username = ? WHERE folder_id = ?",
+		}
+		for _, statement := range statements {
+			_, err = q.Exec(statement, to, id)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		objectIDs, err := queryObjectIDs(q, "SELECT object_id FROM files WHERE folder_id = ? AND username = owner", id)
+		if err != nil {
+			return nil, err
+		}
+		for _, objectID := range objectIDs {
+			digests, err := transferFile(q, objectID, to, false)
+			if err != nil {
+				return nil, err
+			}
+			released = append(released, digests...)
+		}
+	}
+	return released, nil
+}
+
+// Make a user the owner of the given files and folders, with everything
+// inside the folders, and move the charge for them to the new owner's
+// quota, failing with errQuotaExceeded if it doesn't fit. Everything
+// happens in one transaction, so a failed transfer changes nothing.
+func transferItems(from, to string, objectIDs, folderIDs []string) error {
+	// quota checks wait until the new owner has been charged
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	released, err := rewriteOwnership(tx, from, to, objectIDs, folderIDs)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, digest := range released {
+		err = releaseBlob(digest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Do the work of transferItems through q, returning the blobs to release
+// once it is committed. The caller must hold quotaLock.
+func rewriteOwnership(q dbQuerier, from, to string, objectIDs, folderIDs []string) (released []string, err error) {
+	var trees [][]string
+	allObjectIDs := append([]string{}, objectIDs...)
+	for _, folderID := range folderIDs {
+		tree, err := folderTree(q, folderID)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, tree)
+		for _, id := range tree {
+			ids, err := queryObjectIDs(q, "SELECT object_id FROM files WHERE folder_id = ? AND username = owner", id)
+			if err != nil {
+				return nil, err
+			}
+			allObjectIDs = append(allObjectIDs, ids...)
+		}
+	}
+
+	size, err := transferSize(q, allObjectIDs)
+	if err != nil {
+		return nil, err
+	}
+	err = chargeQuota(q, to, size)
+	if err != nil {
+		return nil, err
+	}
+	err = addQuotaUsed(q, from, -size)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, objectID := range objectIDs {
+		digests, err := transferFile(q, objectID, to, true)
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, digests...)
+	}
+	for i, folderID := range folderIDs {
+		digests, err := transferFolder(q, folderID, to, trees[i])
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, digests...)
+	}
+	return released, nil
+}
+
+// Add a transfer to the audit trail
+func recordTransfer(kind, name, from, to, by string) error {
+	_, err := db.Exec("INSERT INTO transfers (kind, name, from_user, to_user, by_user, occurred) VALUES (?, ?, ?, ?, ?, ?)",
+		kind, name, from, to, by, time.Now().Unix())
+	return err
+}
+
+// Check the recipient of a transfer.
+// Writes an error response and returns false if they can't receive it.
+func checkTransferRecipient(response http.ResponseWriter, from, to string) bool {
+	if from == to {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "%s already owns it", to)
+		return false
+	}
+	err := checkUserExists(to)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return false
+	}
+	return true
+}
+
+// Write the response for a failed transfer
+func transferFailed(response http.ResponseWriter, to string, err error) {
+	if err == errQuotaExceeded {
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprint(response, quotaExceededMessage(to))
+		return
+	}
+	response.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprint(response, err.Error())
+}
+
+// transferOfferInfo helps you pass information about a transfer waiting
+// for its recipient to the template
+type transferOfferInfo struct {
+	ID          int64
+	From        string
+	Description string
+}
+
+// Describe what a transfer of the given kind hands over, for messages
+func describeTransfer(kind, name, from string) string {
+	switch kind {
+	case "file":
+		return "the file " + name
+	case "folder":
+		return "the folder " + name
+	default:
+		return "all of " + from + "'s files"
+	}
+}
+
+// Transfer the item of the given kind, which is a file or folder ID or
+// unused for "all", and record it. Returns the name to record the
+// transfer under.
+func performTransfer(kind, itemID, from, to, by string) (name string, err error) {
+	switch kind {
+	case "file":
+		name, err = ownedFilename(from, itemID)
+		if err == nil {
+			err = transferItems(from, to, []string{itemID}, nil)
+		}
+	case "folder":
+		var folder folderInfo
+		folder, err = lookupFolder(itemID)
+		if err == nil {
+			name = folder.Name
+			err = transferItems(from, to, nil, []string{itemID})
+		}
+	default:
+		var fileIDs, folderIDs []string
+		fileIDs, err = queryObjectIDs(db, "SELECT object_id FROM files WHERE owner = ? AND username = owner AND folder_id = ''", from)
+		if err == nil {
+			folderIDs, err = queryObjectIDs(db, "SELECT id FROM folders WHERE owner = ? AND parent_id = ''", from)
+		}
+		if err == nil {
+			name = fmt.Sprintf("%d files and %d folders", len(fileIDs), len(folderIDs))
+			err = transferItems(from, to, fileIDs, folderIDs)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return name, recordTransfer(kind, name, from, to, by)
+}
+
+// Transfer an item on behalf of the given user, or offer it to the
+// recipient if they have to accept it first, then redirect to next
+func offerTransfer(response http.ResponseWriter, request *http.Request, username, kind, itemID, name, from, to, next string) {
+	immediate := isAdmin(username)
+	if !immediate {
+		pending, err := sharePending(to, from)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		immediate = !pending
+	}
+
+	var err error
+	if immediate {
+		name, err = performTransfer(kind, itemID, from, to, username)
+		if err != nil {
+			transferFailed(response, to, err)
+			return
+		}
+		err = notify(to, fmt.Sprintf("%s transferred %s to you", username, describeTransfer(kind, name, from)))
+	} else {
+		_, err = db.Exec("INSERT OR IGNORE INTO transfer_offers (kind, item_id, name, from_user, to_user, created) VALUES (?, ?, ?, ?, ?, ?)",
+			kind, itemID, name, from, to, time.Now().Unix())
+		if err == nil {
+			err = notify(to, fmt.Sprintf("%s wants to transfer %s to you. Accept or decline it in your inbox.", from, describeTransfer(kind, name, from)))
+		}
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, next, http.StatusFound)
+}
+
+// Handle POST /file/{id}/transfer: give a file to the user in the form
+// value username
+func transferFileOwnership(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	to := request.FormValue("username")
+
+	from, err := fileOwner(objectID)
+	if err == sql.ErrNoRows || (err == nil && from != username && !isAdmin(username)) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to transfer file")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if !checkTransferRecipient(response, from, to) {
+		return
+	}
+	filename, err := ownedFilename(from, objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	offerTransfer(response, request, username, "file", objectID, filename, from, to, "/list")
+}
+
+// Handle POST /folders/{id}/transfer: give a folder and everything inside
+// it to the user in the form value username
+func transferFolderOwnership(response http.ResponseWriter, request *http.Request, username, folderID string) {
+	to := request.FormValue("username")
+
+	folder, err := lookupFolder(folderID)
+	if err == sql.ErrNoRows || (err == nil && folder.Owner != username && !isAdmin(username)) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to transfer folder")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if !checkTransferRecipient(response, folder.Owner, to) {
+		return
+	}
+
+	offerTransfer(response, request, username, "folder", folderID, folder.Name, folder.Owner, to, "/list")
+}
+
+// Handle POST /transfers: give all of a user's files and folders to the
+// user in the form value username. Administrators may name the user to
+// transfer from in the form value from.
+func transferAllOwnership(response http.ResponseWriter, request *http.Request, username string) {
+	to := request.FormValue("username")
+	from := request.FormValue("from")
+	if from == "" {
+		from = username
+	}
+
+	if from != username && !isAdmin(username) {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to transfer another user's files")
+		return
+	}
+	if !checkTransferRecipient(response, from, to) {
+		return
+	}
+
+	offerTransfer(response, request, username, "all", "", "", from, to, "/transfers")
+}
+
+// Return the transfers waiting for the given user to accept them
+func listTransferOffers(username string) ([]transferOfferInfo, error) {
+	rows, err := db.Query("SELECT id, kind, name, from_user FROM transfer_offers WHERE to_user = ? ORDER BY created", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	offers := make([]transferOfferInfo, 0)
+	for rows.Next() {
+		var offer transferOfferInfo
+		var kind, name string
+		err = rows.Scan(&offer.ID, &kind, &name, &offer.From)
+		if err != nil {
+			return nil, err
+		}
+		offer.Description = describeTransfer(kind, name, offer.From)
+		offers = append(offers, offer)
+	}
+	return offers, rows.Err()
+}
+
+// Return true if the sender of a transfer offer still owns what they offered
+func transferOfferValid(kind, itemID, from string) (bool, error) {
+	var owner string
+	var err error
+	switch kind {
+	case "file":
+		owner, err = fileOwner(itemID)
+	case "folder":
+		var folder folderInfo
+		folder, err = lookupFolder(itemID)
+		owner = folder.Owner
+	default:
+		return true, nil
+	}
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return owner == from, err
+}
+
+// Accept a transfer offered to the user, taking over what was offered
+func acceptTransferOffer(response http.ResponseWriter, request *http.Request, username, offerID string) {
+	var kind, itemID, name, from string
+	row := db.QueryRow("SELECT kind, item_id, name, from_user FROM transfer_offers WHERE id = ? AND to_user = ?", offerID, username)
+	err := row.Scan(&kind, &itemID, &name, &from)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "no such invitation")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	valid, err := transferOfferValid(kind, itemID, from)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if !valid {
+		_, err = db.Exec("DELETE FROM transfer_offers WHERE id = ?", offerID)
+		if err != nil {
+			log.Error(err)
+		}
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(response, "%s no longer owns %s", from, describeTransfer(kind, name, from))
+		return
+	}
+
+	// an offer that doesn't fit in the quota stays, so it can be accepted
+	// once there is room
+	name, err = performTransfer(kind, itemID, from, username, from)
+	if err != nil {
+		transferFailed(response, username, err)
+		return
+	}
+	_, err = db.Exec("DELETE FROM transfer_offers WHERE id = ?", offerID)
+	if err == nil {
+		err = notify(from, fmt.Sprintf("%s accepted %s", username, describeTransfer(kind, name, from)))
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/inbox", http.StatusFound)
+}
+
+// Decline a transfer offered to the user, leaving everything with its owner
+func declineTransferOffer(response http.ResponseWriter, request *http.Request, username, offerID string) {
+	var kind, name, from string
+	row := db.QueryRow("SELECT kind, name, from_user FROM transfer_offers WHERE id = ? AND to_user = ?", offerID, username)
+	err := row.Scan(&kind, &name, &from)
+	if err == nil {
+		err = notify(from, fmt.Sprintf("%s declined %s", username, describeTransfer(kind, name, from)))
+	}
+	if err != nil && err != sql.ErrNoRows {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM transfer_offers WHERE id = ? AND to_user = ?", offerID, username)
+	finishInvitation(response, request, result, err)
+}
+
+// Handle GET /transfers: show the transfers the user took part in, or every
+// transfer for administrators, along with a form for transferring all files
+func listTransfers(response http.ResponseWriter, request *http.Request, username string) {
+	var rows *sql.Rows
+	var err error
+	if isAdmin(username) {
+		rows, err = db.Query("SELECT kind, name, from_user, to_user, by_user, occurred FROM transfers ORDER BY occurred DESC, id DESC")
+	} else {
+		rows, err = db.Query(`SELECT kind, name, from_user, to_user, by_user, occurred FROM transfers
+			WHERE from_user = ? OR to_user = ? OR by_user = ? ORDER BY occurred DESC, id DESC`, username, username, username)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	transfers := make([]transferInfo, 0)
+	for rows.Next() {
+		var transfer transferInfo
+		var occurred int64
+		err = rows.Scan(&transfer.Kind, &transfer.Name, &transfer.From, &transfer.To, &transfer.By, &occurred)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		transfer.Occurred = time.Unix(occurred, 0)
+		transfers = append(transfers, transfer)
+	}
+
+	data := map[string]interface{}{
+		"Username":  username,
+		"Transfers": transfers,
+		"IsAdmin":   isAdmin(username),
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/transfers.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
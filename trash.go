@@ -0,0 +1,242 @@
+// Trash bin for deleted files.
+//
+// Deleting a file moves its row in the files table, together with every
+// shared copy, into the trash table. Restoring moves the rows back, so the
+// file returns to its folder with the same shares. Files are purged
+// for good once they have been in the trash for longer than trashRetention.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Columns copied between the files and trash tables
+const fileColumns = "owner, username, filename, object_id, digest, folder_id, size, content_type, uploaded, modified, role, pending"
+
+// trashInfo helps you pass information about a deleted file to the template
+type trashInfo struct {
+	Filename string
+	ObjectID string
+	Deleted  time.Time
+	Purge    time.Time
+}
+
+// Move a file and all its shared copies into the trash
+func trashFile(objectID string) error {
+	_, err := db.Exec("INSERT INTO trash ("+fileColumns+", deleted) SELECT "+fileColumns+", ? FROM files WHERE object_id = ?", time.Now().Unix(), objectID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM files WHERE object_id = ?", objectID)
+	return err
+}
+
+// Remove a file from the trash for good, along with its versions. The blobs
+// holding its contents are deleted once nothing else refers to them, and
+// the space its versions took up is given back to the owner.
+func purgeFile(objectID string) error {
+	digests, err := queryDigests(db, "SELECT digest FROM trash WHERE object_id = ? UNION ALL SELECT digest FROM versions WHERE object_id = ?", objectID, objectID)
+	if err != nil {
+		return err
+	}
+
+	var owner string
+	var size int64
+	row := db.QueryRow("SELECT owner, (SELECT IFNULL(SUM(size), 0) FROM versions WHERE object_id = ?) FROM trash WHERE object_id = ? AND username = owner", objectID, objectID)
+	err = row.Scan(&owner, &size)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM trash WHERE object_id = ?", objectID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM versions WHERE object_id = ?", objectID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM share_links WHERE object_id = ?", objectID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM file_group_shares WHERE object_id = ?", objectID)
+	if err != nil {
+		return err
+	}
+
+	for _, digest := range digests {
+		err = releaseBlob(digest)
+		if err != nil {
+			return err
+		}
+	}
+	return releaseQuota(owner, size)
+}
+
+// Purge every file that has been in the trash for longer than trashRetention
+func purgeTrash() {
+	cutoff := time.Now().Add(-trashRetention).Unix()
+	rows, err := db.Query("SELECT DISTINCT object_id FROM trash WHERE deleted < ?", cutoff)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	var expired []string
+	for rows.Next() {
+		var objectID string
+		err = rows.Scan(&objectID)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		expired = append(expired, objectID)
+	}
+	rows.Close()
+
+	for _, objectID := range expired {
+		err = purgeFile(objectID)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	if len(expired) > 0 {
+		log.Infof("purged %d files from the trash", len(expired))
+	}
+}
+
+// Look up a file in the given user's trash.
+// Writes an error response and returns false if there is no such file.
+func checkTrashOwner(response http.ResponseWriter, username, objectID string) (filename, folderID string, ok bool) {
+	row := db.QueryRow("SELECT filename, folder_id FROM trash WHERE owner = ? AND username = owner AND object_id = ?", username, objectID)
+	err := row.Scan(&filename, &folderID)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "no such file in the trash")
+		return "", "", false
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return "", "", false
+	}
+	return filename, folderID, true
+}
+
+// Show the files in the user's trash, most recently deleted first
+func listTrash(response http.ResponseWriter, request *http.Request, username string) {
+	rows, err := db.Query("SELECT filename, object_id, deleted FROM trash WHERE owner = ? AND username = owner ORDER BY deleted DESC", username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	files := make([]trashInfo, 0)
+	for rows.Next() {
+		var file trashInfo
+		var deleted int64
+		err = rows.Scan(&file.Filename, &file.ObjectID, &deleted)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		file.Deleted = time.Unix(deleted, 0)
+		file.Purge = file.Deleted.Add(trashRetention)
+		files = append(files, file)
+	}
+
+	data := map[string]interface{}{
+		"Username": username,
+		"Files":    files,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/trash.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Move a file out of the trash, back to its original folder and shares.
+// If the folder no longer exists the file is restored to the top level.
+func restoreFile(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	filename, folderID, ok := checkTrashOwner(response, username, objectID)
+	if !ok {
+		return
+	}
+
+	if checkFolderOwner(username, folderID) != nil {
+		folderID = ""
+	}
+	err := checkFilenameFree(username, folderID, filename, objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error()+", rename or move it first")
+		return
+	}
+
+	_, err = db.Exec("INSERT INTO files ("+fileColumns+") SELECT "+fileColumns+" FROM trash WHERE object_id = ?", objectID)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM trash WHERE object_id = ?", objectID)
+	}
+	if err == nil {
+		_, err = db.Exec("UPDATE files SET folder_id = ? WHERE object_id = ?", folderID, objectID)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	redirectToFolder(response, request, folderID)
+}
+
+// Delete a file from the trash right away instead of waiting for it to be purged
+func deleteFromTrash(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	_, _, ok := checkTrashOwner(response, username, objectID)
+	if !ok {
+		return
+	}
+
+	err := purgeFile(objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/trash", http.StatusFound)
+}
+
+// Entry point for POST requests to /trash/{id}/{action}
+func handleTrashAction(response http.ResponseWriter, request *http.Request, username string) {
+	path := strings.Split(strings.TrimPrefix(request.URL.Path, "/trash/"), "/")
+	if len(path) != 2 {
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "not found")
+		return
+	}
+
+	switch path[1] {
+	case "restore":
+		restoreFile(response, request, username, path[0])
+	case "delete":
+		deleteFromTrash(response, request, username, path[0])
+
+	default:
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "not found")
+	}
+}
@@ -0,0 +1,431 @@
+// Resumable uploads following the tus protocol (https://tus.io), version 1.0.0.
+//
+// A client creates an upload with POST /uploads/, asks how much of it the
+// server already has with HEAD /uploads/{id}, and sends the remaining bytes
+// with PATCH /uploads/{id}. Once every byte has arrived the upload is moved
+// into the blob store and recorded in the files table, exactly like a file
+// sent through processUpload. Uploads that see no progress for
+// uploadExpiration are purged in the background.
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const tusVersion = "1.0.0"
+
+// Uploads that currently have a PATCH request writing to them
+var activeUploads = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+// uploadInfo describes an upload in progress
+type uploadInfo struct {
+	FolderID  string
+	ReplaceID string // file the upload becomes a new version of, if any
+	Filename  string
+	Length    int64
+	Offset    int64
+	Expires   time.Time
+}
+
+// Return the on-disk location of the partially received upload with the given ID
+func uploadPath(uploadID string) string {
+	return filepath.Join(filePath, "upload-"+uploadID+".part")
+}
+
+// Entry point for requests to /uploads/
+func handleTusRequest(response http.ResponseWriter, request *http.Request, username string) {
+	header := response.Header()
+	header.Set("Tus-Resumable", tusVersion)
+
+	if request.Method == "OPTIONS" {
+		header.Set("Tus-Version", tusVersion)
+		header.Set("Tus-Extension", "creation,expiration")
+		header.Set("Tus-Max-Size", strconv.Itoa(maxUploadSize))
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if request.Header.Get("Tus-Resumable") != tusVersion {
+		header.Set("Tus-Version", tusVersion)
+		response.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprint(response, "unsupported tus version")
+		return
+	}
+
+	uploadID := strings.TrimPrefix(request.URL.Path, "/uploads/")
+
+	switch {
+	case request.Method == "POST" && uploadID == "":
+		createUpload(response, request, username)
+	case request.Method == "HEAD" && uploadID != "":
+		getUploadOffset(response, request, username, uploadID)
+	case request.Method == "PATCH" && uploadID != "":
+		patchUpload(response, request, username, uploadID)
+
+	default:
+		header.Set("Allow", "OPTIONS, POST, HEAD, PATCH")
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(response, "Unrecognized method")
+	}
+}
+
+// Parse the Upload-Metadata header: comma-separated pairs of a key and
+// an optional base64 encoded value
+func parseUploadMetadata(value string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if value == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("malformed upload metadata %q", pair)
+		}
+		if len(fields) == 1 {
+			metadata[fields[0]] = ""
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed upload metadata %q", pair)
+		}
+		metadata[fields[0]] = string(decoded)
+	}
+	return metadata, nil
+}
+
+// Handle POST /uploads/: create a new, empty upload
+func createUpload(response http.ResponseWriter, request *http.Request, username string) {
+	length, err := strconv.ParseInt(request.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "missing or invalid Upload-Length")
+		return
+	}
+	if length > maxUploadSize {
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(response, "file exceeds the maximum upload size of %d bytes", maxUploadSize)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(request.Header.Get("Upload-Metadata"))
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	// like processUpload, the upload either replaces an existing file
+	// or adds a file to one of the user's own folders
+	filename := metadata["filename"]
+	folderID := metadata["folder"]
+	replaceID := metadata["replace"]
+	owner := username
+	if replaceID != "" {
+		owner, err = checkEditor(username, replaceID)
+		folderID = ""
+	} else if !validFilename(filename) {
+		err = errors.New("invalid file name")
+	} else {
+		err = checkFolderOwner(username, folderID)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	remaining, err := quotaRemaining(owner)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if length > remaining {
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprint(response, quotaExceededMessage(owner))
+		return
+	}
+
+	uploadID, err := randomByteString(16)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	// create the file that received chunks are appended to
+	partFile, err := os.OpenFile(uploadPath(uploadID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	partFile.Close()
+
+	expires := time.Now().Add(uploadExpiration)
+	upload := uploadInfo{FolderID: folderID, ReplaceID: replaceID, Filename: filename, Length: length, Expires: expires}
+	_, err = db.Exec("INSERT INTO uploads (id, username, folder_id, replace_id, filename, length, upload_offset, expires) VALUES (?, ?, ?, ?, ?, ?, 0, ?)",
+		uploadID, username, folderID, replaceID, filename, length, expires.Unix())
+	if err != nil {
+		os.Remove(uploadPath(uploadID))
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	// an empty file is complete as soon as it is created
+	if length == 0 {
+		owner, err = finishUpload(uploadID, username, upload)
+		if err == errQuotaExceeded {
+			// the quota filled up while the upload was in progress
+			response.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprint(response, quotaExceededMessage(owner))
+			return
+		} else if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+	}
+
+	response.Header().Set("Location", "/uploads/"+uploadID)
+	response.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	response.WriteHeader(http.StatusCreated)
+}
+
+// Look up an upload belonging to the given user.
+// Writes an error response and returns false if there is no such upload.
+func lookupUpload(response http.ResponseWriter, username, uploadID string) (upload uploadInfo, ok bool) {
+	row := db.QueryRow("SELECT folder_id, replace_id, filename, length, upload_offset, expires FROM uploads WHERE id = ? AND username = ?", uploadID, username)
+
+	var expiresUnix int64
+	err := row.Scan(&upload.FolderID, &upload.ReplaceID, &upload.Filename, &upload.Length, &upload.Offset, &expiresUnix)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	upload.Expires = time.Unix(expiresUnix, 0)
+	if upload.Expires.Before(time.Now()) {
+		response.WriteHeader(http.StatusGone)
+		return
+	}
+	ok = true
+	return
+}
+
+// Handle HEAD /uploads/{id}: report how many bytes have been received
+func getUploadOffset(response http.ResponseWriter, request *http.Request, username, uploadID string) {
+	response.Header().Set("Cache-Control", "no-store")
+
+	upload, ok := lookupUpload(response, username, uploadID)
+	if !ok {
+		return
+	}
+
+	response.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	response.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	response.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	response.WriteHeader(http.StatusOK)
+}
+
+// Handle PATCH /uploads/{id}: append a chunk at the current offset
+func patchUpload(response http.ResponseWriter, request *http.Request, username, uploadID string) {
+	if request.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		response.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprint(response, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	// only one request may write to an upload at a time
+	activeUploads.Lock()
+	busy := activeUploads.ids[uploadID]
+	activeUploads.ids[uploadID] = true
+	activeUploads.Unlock()
+	if busy {
+		response.WriteHeader(http.StatusLocked)
+		fmt.Fprint(response, "upload is already in progress")
+		return
+	}
+	defer func() {
+		activeUploads.Lock()
+		delete(activeUploads.ids, uploadID)
+		activeUploads.Unlock()
+	}()
+
+	upload, ok := lookupUpload(response, username, uploadID)
+	if !ok {
+		return
+	}
+	length, offset := upload.Length, upload.Offset
+
+	requestOffset, err := strconv.ParseInt(request.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset != offset {
+		response.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(response, "upload offset does not match, expected %d", offset)
+		return
+	}
+
+	partFile, err := os.OpenFile(uploadPath(uploadID), os.O_WRONLY, 0644)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	_, err = partFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		partFile.Close()
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	// never accept more bytes than the upload was declared to have.
+	// if the client disconnects halfway, whatever arrived is kept so
+	// that the upload can be resumed from there.
+	written, copyErr := io.Copy(partFile, io.LimitReader(request.Body, length-offset))
+	closeErr := partFile.Close()
+	if closeErr != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, closeErr.Error())
+		return
+	}
+
+	offset += written
+	expires := time.Now().Add(uploadExpiration)
+	_, err = db.Exec("UPDATE uploads SET upload_offset = ?, expires = ? WHERE id = ?", offset, expires.Unix(), uploadID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if copyErr != nil {
+		log.Error(copyErr)
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, copyErr.Error())
+		return
+	}
+
+	if offset == length {
+		owner, err := finishUpload(uploadID, username, upload)
+		if err == errQuotaExceeded {
+			// the quota filled up while the upload was in progress
+			response.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprint(response, quotaExceededMessage(owner))
+			return
+		} else if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+	}
+
+	response.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	response.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// Move a completely received upload into the blob store and record it in
+// the files table. Returns the user the upload was charged to.
+func finishUpload(uploadID, username string, upload uploadInfo) (owner string, err error) {
+	owner = username
+	if upload.ReplaceID != "" {
+		// the user may have lost access while the upload was in progress
+		owner, err = checkEditor(username, upload.ReplaceID)
+		if err != nil {
+			return owner, err
+		}
+	}
+
+	partFile, err := os.Open(uploadPath(uploadID))
+	if err != nil {
+		return owner, err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, partFile)
+	partFile.Close()
+	if err != nil {
+		return owner, err
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	_, err = db.Exec("DELETE FROM uploads WHERE id = ?", uploadID)
+	if err != nil {
+		return owner, err
+	}
+
+	err = commitBlob(uploadPath(uploadID), digest, upload.Length)
+	if err != nil {
+		return owner, err
+	}
+	if upload.ReplaceID != "" {
+		return owner, replaceFile(owner, username, upload.ReplaceID, digest, upload.Length)
+	}
+	_, err = addFile(username, upload.FolderID, upload.Filename, digest, upload.Length, true)
+	return owner, err
+}
+
+// Delete uploads that have expired along with the data received for them
+func purgeExpiredUploads() {
+	rows, err := db.Query("SELECT id FROM uploads WHERE expires < ?", time.Now().Unix())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	var expired []string
+	for rows.Next() {
+		var uploadID string
+		err = rows.Scan(&uploadID)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		expired = append(expired, uploadID)
+	}
+	rows.Close()
+
+	for _, uploadID := range expired {
+		// leave uploads alone while a request is still writing to them
+		activeUploads.Lock()
+		busy := activeUploads.ids[uploadID]
+		activeUploads.Unlock()
+		if busy {
+			continue
+		}
+
+		_, err = db.Exec("DELETE FROM uploads WHERE id = ?", uploadID)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		err = os.Remove(uploadPath(uploadID))
+		if err != nil && !os.IsNotExist(err) {
+			log.Error(err)
+		}
+	}
+	if len(expired) > 0 {
+		log.Infof("purged %d expired uploads", len(expired))
+	}
+}
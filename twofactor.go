@@ -0,0 +1,406 @@
+// Two-factor authentication with time-based one-time passwords (RFC 6238).
+//
+// Users enroll from /2fa by adding the secret to an authenticator app and
+// entering a code from it. From then on, logging in takes their password
+// followed by a code, or one of the recovery codes they were given when
+// enrolling, each of which works only once. Between the two steps the
+// login is tracked by a short-lived challenge cookie rather than a session.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Size of TOTP secrets, as recommended by RFC 4226
+const totpSecretSizeBytes = 20
+
+// Base32 without padding, as authenticator apps expect secrets
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Return the code for the given time step, as described in RFC 4226
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// Return the URI that sets up an authenticator app with a secret
+func totpURI(username, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int64(totpPeriod/time.Second)))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + query.Encode()
+}
+
+// Return true if the given user has finished enrolling in two-factor authentication
+func twoFactorEnabled(username string) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT enabled FROM totp WHERE username = ?", username).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// Return true if code is the user's current TOTP code. Each code is only
+// accepted once, so someone watching the user type it can't reuse it.
+func checkTOTP(username, code string) (bool, error) {
+	var encodedSecret string
+	var lastStep int64
+	err := db.QueryRow("SELECT secret, last_step FROM totp WHERE username = ?", username).Scan(&encodedSecret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().Unix() / int64(totpPeriod/time.Second)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep || !hmac.Equal([]byte(code), []byte(totpCode(secret, step))) {
+			continue
+		}
+		// only one request may use up the code
+		result, err := db.Exec("UPDATE totp SET last_step = ? WHERE username = ? AND last_step < ?", step, username, step)
+		if err != nil {
+			return false, err
+		}
+		count, _ := result.RowsAffected()
+		return count > 0, nil
+	}
+	return false, nil
+}
+
+// Return the hash a recovery code is stored as. Recovery codes are random,
+// so unlike passwords they don't need a slow hash.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Replace the user's recovery codes with new ones, returning them
+func newRecoveryCodes(username string) ([]string, error) {
+	_, err := db.Exec("DELETE FROM recovery_codes WHERE username = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i], err = randomByteString(5)
+		if err != nil {
+			return nil, err
+		}
+		_, err = db.Exec("INSERT INTO recovery_codes (username, code) VALUES (?, ?)", username, hashRecoveryCode(codes[i]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// Return true if code is one of the user's unused recovery codes, using it up
+func redeemRecoveryCode(username, code string) (bool, error) {
+	result, err := db.Exec("DELETE FROM recovery_codes WHERE username = ? AND code = ?", username, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	count, _ := result.RowsAffected()
+	return count > 0, nil
+}
+
+// Entry point for requests to /2fa and /2fa/{setup|enable|disable}
+func handleTwoFactorRequest(response http.ResponseWriter, request *http.Request, username string) {
+	switch {
+	case request.URL.Path == "/2fa" && request.Method == "GET":
+		showTwoFactor(response, username, nil)
+	case request.URL.Path == "/2fa/setup" && request.Method == "POST":
+		setupTwoFactor(response, request, username)
+	case request.URL.Path == "/2fa/enable" && request.Method == "POST":
+		enableTwoFactor(response, request, username)
+	case request.URL.Path == "/2fa/disable" && request.Method == "POST":
+		disableTwoFactor(response, request, username)
+
+	default:
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "not found")
+	}
+}
+
+// Show whether the user has two-factor authentication, how to set it up if
+// they are enrolling, and their new recovery codes if they just enrolled
+func showTwoFactor(response http.ResponseWriter, username string, recoveryCodes []string) {
+	var secret string
+	var enabled bool
+	err := db.QueryRow("SELECT secret, enabled FROM totp WHERE username = ?", username).Scan(&secret, &enabled)
+	if err != nil && err != sql.ErrNoRows {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	var remaining int
+	err = db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE username = ?", username).Scan(&remaining)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Username":      username,
+		"Enabled":       enabled,
+		"Enrolling":     secret != "" && !enabled,
+		"RecoveryCodes": recoveryCodes,
+		"Remaining":     remaining,
+	}
+	if secret != "" && !enabled {
+		data["Secret"] = secret
+		// html/template only allows known URL schemes in links
+		data["URI"] = template.URL(totpURI(username, secret))
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/2fa.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Start enrolling the user, with a new secret for their authenticator app
+func setupTwoFactor(response http.ResponseWriter, request *http.Request, username string) {
+	enabled, err := twoFactorEnabled(username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if enabled {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "two-factor authentication is already enabled")
+		return
+	}
+
+	secret := make([]byte, totpSecretSizeBytes)
+	_, err = rand.Read(secret)
+	if err == nil {
+		_, err = db.Exec("INSERT OR REPLACE INTO totp (username, secret, enabled, last_step) VALUES (?, ?, 0, 0)", username, totpEncoding.EncodeToString(secret))
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/2fa", http.StatusFound)
+}
+
+// Finish enrolling the user once they enter a code from their
+// authenticator app, showing them their recovery codes
+func enableTwoFactor(response http.ResponseWriter, request *http.Request, username string) {
+	enabled, err := twoFactorEnabled(username)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if enabled {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "two-factor authentication is already enabled")
+		return
+	}
+
+	correct, err := checkTOTP(username, request.FormValue("code"))
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if !correct {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "incorrect code")
+		return
+	}
+
+	codes, err := newRecoveryCodes(username)
+	if err == nil {
+		_, err = db.Exec("UPDATE totp SET enabled = 1 WHERE username = ?", username)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	showTwoFactor(response, username, codes)
+}
+
+// Turn off two-factor authentication, once the user has entered their
+// password again. Wrong passwords count as failed logins, so a stolen
+// session can't be used to guess the password.
+func disableTwoFactor(response http.ResponseWriter, request *http.Request, username string) {
+	if !claimLoginAttempt(response, request, username) {
+		return
+	}
+	correct, err := checkPassword(username, request.FormValue("password"))
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if !correct {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "incorrect password")
+		return
+	}
+	loginSucceeded(request, username)
+
+	_, err = db.Exec("DELETE FROM totp WHERE username = ?", username)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM recovery_codes WHERE username = ?", username)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/2fa", http.StatusFound)
+}
+
+// Ask a user who entered their password for a code, remembering who they
+// are with a challenge cookie
+func startTwoFactorLogin(response http.ResponseWriter, username string) {
+	token, err := randomByteString(16)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM login_challenges WHERE expires <= ?", time.Now().Unix())
+	}
+	expires := time.Now().Add(loginChallengeDuration)
+	if err == nil {
+		_, err = db.Exec("INSERT INTO login_challenges VALUES (?, ?, ?, 0)", token, username, expires.Unix())
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.SetCookie(response, &http.Cookie{
+		Name:     "login_challenge",
+		Value:    token,
+		Path:     "/login",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	showTwoFactorLoginPage(response, "")
+}
+
+// Handle POST /login/2fa: log in a user who entered their password, once
+// they enter a code from their authenticator app or a recovery code
+func processTwoFactorLogin(response http.ResponseWriter, request *http.Request) {
+	cookie, err := request.Cookie("login_challenge")
+	if err != nil {
+		response.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(response, "log in with your password first")
+		return
+	}
+
+	var username string
+	var attempts int
+	row := db.QueryRow("SELECT username, attempts FROM login_challenges WHERE token = ? AND expires > ?", cookie.Value, time.Now().Unix())
+	err = row.Scan(&username, &attempts)
+	if err == sql.ErrNoRows || (err == nil && attempts >= maxTwoFactorAttempts) {
+		db.Exec("DELETE FROM login_challenges WHERE token = ?", cookie.Value)
+		response.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(response, "log in with your password first")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	code := strings.TrimSpace(request.FormValue("code"))
+	correct, err := checkTOTP(username, code)
+	if err == nil && !correct {
+		correct, err = redeemRecoveryCode(username, code)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	if !correct {
+		_, err = db.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE token = ?", cookie.Value)
+		if err != nil {
+			log.Error(err)
+		}
+		response.WriteHeader(http.StatusUnauthorized)
+		showTwoFactorLoginPage(response, "incorrect code")
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM login_challenges WHERE token = ?", cookie.Value)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	cookie.Path = "/login"
+	cookie.MaxAge = -1
+	http.SetCookie(response, cookie)
+	loginSucceeded(request, username)
+
+	initSession(response, username)
+	http.Redirect(response, request, "/", http.StatusFound)
+}
+
+// Show the form asking for a code during login
+func showTwoFactorLoginPage(response http.ResponseWriter, message string) {
+	data := map[string]interface{}{
+		"Error": message,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/login2fa.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
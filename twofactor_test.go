@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+// The HOTP test values from RFC 4226, appendix D
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for step, code := range want {
+		if got := totpCode(secret, int64(step)); got != code {
+			t.Errorf("step %d: got %s, want %s", step, got, code)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Version history of uploaded files.
+//
+// Every upload of a file is kept as a row in the versions table, each row
+// holding a reference to its blob. The files table always points at the
+// contents of the newest version, so everyone the file is shared with sees
+// the current version.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// versionInfo helps pass information about a file version to the template
+type versionInfo struct {
+	Number   int
+	Size     int64
+	Uploader string
+	Created  time.Time
+	Current  bool
+}
+
+// Insert a row into the versions table for the given file.
+// The version takes over the blob reference held by the caller.
+func recordVersion(objectID, uploader, digest string, size int64) error {
+	_, err := db.Exec(`INSERT INTO versions (object_id, number, digest, size, uploader, created)
+		SELECT ?, IFNULL(MAX(number), 0) + 1, ?, ?, ?, ? FROM versions WHERE object_id = ?`,
+		objectID, digest, size, uploader, time.Now().Unix(), objectID)
+	if err != nil {
+		releaseBlob(digest)
+		return err
+	}
+	return nil
+}
+
+// Add a new version to an existing file and make it the current one.
+// The version takes over the blob reference held by the caller.
+func addVersion(objectID, uploader, digest string, size int64) error {
+	err := recordVersion(objectID, uploader, digest, size)
+	if err != nil {
+		return err
+	}
+	return setFileContents(objectID, digest, size)
+}
+
+// Return the owner of a file
+func fileOwner(objectID string) (owner string, err error) {
+	err = db.QueryRow("SELECT owner FROM files WHERE object_id = ? AND username = owner", objectID).Scan(&owner)
+	return
+}
+
+// Check that the given user may upload new versions of a file, returning
+// the file's owner
+func checkEditor(username, objectID string) (owner string, err error) {
+	role, err := fileRole(username, objectID)
+	if err != nil {
+		return "", err
+	}
+	if !roleAtLeast(role, roleEditor) {
+		return "", errors.New("not authorized to upload a new version of this file")
+	}
+	return fileOwner(objectID)
+}
+
+// Add a new version uploaded by uploader to a file, charging it to the
+// owner's quota. Fails with errQuotaExceeded if it doesn't fit. The version
+// takes over the blob reference held by the caller.
+func replaceFile(owner, uploader, objectID, digest string, size int64) error {
+	err := reserveQuota(owner, size)
+	if err != nil {
+		releaseBlob(digest)
+		return err
+	}
+	err = addVersion(objectID, uploader, digest, size)
+	if err != nil {
+		releaseQuota(owner, size)
+	}
+	return err
+}
+
+// Point every row of the files table for the given file, the owner's and
+// all shared copies, at new contents
+func setFileContents(objectID, digest string, size int64) error {
+	rows, err := db.Query("SELECT digest, filename FROM files WHERE object_id = ?", objectID)
+	if err != nil {
+		return err
+	}
+	var oldDigests []string
+	var filename string
+	for rows.Next() {
+		var oldDigest string
+		err = rows.Scan(&oldDigest, &filename)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		oldDigests = append(oldDigests, oldDigest)
+	}
+	rows.Close()
+
+	// take the new references before dropping the old ones, so that a
+	// blob shared by both is never collected in between
+	for range oldDigests {
+		err = retainBlob(digest)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("UPDATE files SET digest = ?, size = ?, content_type = ?, modified = ? WHERE object_id = ?",
+		digest, size, detectContentType(filename, digest), time.Now().Unix(), objectID)
+	if err != nil {
+		return err
+	}
+	for _, oldDigest := range oldDigests {
+		err = releaseBlob(oldDigest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the name of a file, if it is owned by the given user
+func ownedFilename(username, objectID string) (filename string, err error) {
+	row := db.QueryRow("SELECT filename FROM files WHERE owner = ? AND username = ? AND object_id = ?", username, username, objectID)
+	err = row.Scan(&filename)
+	return
+}
+
+// Look up a file owned by the given user.
+// Writes an error response and returns false if there is no such file.
+func checkFileOwner(response http.ResponseWriter, username, objectID string) (filename string, ok bool) {
+	filename, err := ownedFilename(username, objectID)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to access file")
+		return "", false
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return "", false
+	}
+	return filename, true
+}
+
+// Look up the contents of one version of a file
+func lookupVersion(objectID, number string) (digest string, size int64, err error) {
+	row := db.QueryRow("SELECT digest, size FROM versions WHERE object_id = ? AND number = ?", objectID, number)
+	err = row.Scan(&digest, &size)
+	return
+}
+
+// Show every version of a file, newest first
+func listVersions(response http.ResponseWriter, request *http.Request, username, objectID string) {
+	filename, ok := checkFileOwner(response, username, objectID)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query("SELECT number, size, uploader, created FROM versions WHERE object_id = ? ORDER BY number DESC", objectID)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	versions := make([]versionInfo, 0)
+	for rows.Next() {
+		var version versionInfo
+		var created int64
+		err = rows.Scan(&version.Number, &version.Size, &version.Uploader, &created)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(response, err.Error())
+			return
+		}
+		version.Created = time.Unix(created, 0)
+		version.Current = len(versions) == 0
+		versions = append(versions, version)
+	}
+
+	data := map[string]interface{}{
+		"Username": username,
+		"Filename": filename,
+		"ObjectID": objectID,
+		"Versions": versions,
+	}
+
+	tmpl, err := template.ParseFiles("templates/base.html", "templates/versions.html")
+	if err != nil {
+		log.Error(err)
+	}
+	err = tmpl.Execute(response, data)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Download an older version of a file
+func getFileVersion(response http.ResponseWriter, request *http.Request, username, objectID, number string) {
+	filename, ok := checkFileOwner(response, username, objectID)
+	if !ok {
+		return
+	}
+
+	digest, _, err := lookupVersion(objectID, number)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "no such version")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	setNameOfServedFile(response, filename)
+	http.ServeFile(response, request, blobPath(digest))
+}
+
+// Make an older version of a file current again. The restored contents are
+// added as a new version, so the history leading up to it is kept.
+func restoreVersion(response http.ResponseWriter, request *http.Request, username, objectID, number string) {
+	_, ok := checkFileOwner(response, username, objectID)
+	if !ok {
+		return
+	}
+
+	digest, size, err := lookupVersion(objectID, number)
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(response, "no such version")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	// the new version needs its own reference to the old contents,
+	// and counts towards the quota like any other upload
+	err = retainBlob(digest)
+	if err == nil {
+		err = replaceFile(username, username, objectID, digest, size)
+	}
+	if err == errQuotaExceeded {
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprint(response, quotaExceededMessage(username))
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	http.Redirect(response, request, "/file/"+objectID+"/versions", http.StatusFound)
+}
+
+// Entry point for requests below /file/{id}/versions
+func handleVersionRequest(response http.ResponseWriter, request *http.Request, username, objectID string, path []string) {
+	switch {
+	case len(path) == 0 && request.Method == "GET":
+		listVersions(response, request, username, objectID)
+	case len(path) == 1 && request.Method == "GET":
+		getFileVersion(response, request, username, objectID, path[0])
+	case len(path) == 2 && path[1] == "restore" && request.Method == "POST":
+		restoreVersion(response, request, username, objectID, path[0])
+
+	default:
+		resolveBadRequestMethod(response)
+	}
+}
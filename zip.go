@@ -0,0 +1,225 @@
+// Downloading several files, or whole folders, as one ZIP archive.
+//
+// GET or POST /download takes any number of file and folder form values.
+// Every file is checked against the same rules as a single download before
+// anything is sent, then the archive is written to the response one file
+// at a time, so it never has to be held in memory.
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// zipEntry is a file or folder to be written to an archive
+type zipEntry struct {
+	Name     string
+	IsFolder bool
+	File     fileInfo // unset for folders
+}
+
+// zipBuilder collects the entries of an archive, keeping their names unique
+type zipBuilder struct {
+	username string
+	entries  []zipEntry
+	names    map[string]bool
+}
+
+// Return name made safe to use as one segment of an entry's path.
+// Segments like ".." would escape the folder the archive is extracted to.
+func zipSegment(name string) string {
+	name = strings.NewReplacer("/", "", "\\", "").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
+
+// Return the path of an entry called name inside folderPath, with a number
+// added to the name if the archive already has an entry with that path
+func (builder *zipBuilder) uniqueName(folderPath, name string) (string, error) {
+	name = zipSegment(name)
+	extension := filepath.Ext(name)
+	base := strings.TrimSuffix(name, extension)
+	candidate := folderPath + name
+	for i := 2; builder.names[candidate]; i++ {
+		candidate = folderPath + base + strconv.Itoa(i) + extension
+	}
+
+	// the segments are safe on their own, this makes sure of the whole path
+	clean := path.Clean(candidate)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("unsafe path %q in archive", candidate)
+	}
+	builder.names[candidate] = true
+	return candidate, nil
+}
+
+// Add a file the user may download to the archive, inside the given
+// folder path. Returns sql.ErrNoRows if they may not download it.
+func (builder *zipBuilder) addFile(objectID, folderPath string) error {
+	file, err := lookupDownload(builder.username, objectID)
+	if err != nil {
+		return err
+	}
+	name, err := builder.uniqueName(folderPath, file.Filename)
+	if err != nil {
+		return err
+	}
+	builder.entries = append(builder.entries, zipEntry{Name: name, File: file})
+	return nil
+}
+
+// Add a folder the user may see to the archive, along with every folder
+// and file inside it. Returns sql.ErrNoRows if they may not see it.
+func (builder *zipBuilder) addFolder(folderID string) error {
+	ok, err := canAccessFolder(builder.username, folderID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	tree, err := folderTree(db, folderID)
+	if err != nil {
+		return err
+	}
+	// parents come before their subfolders, so their paths are known first
+	paths := make(map[string]string)
+	for _, id := range tree {
+		folder, err := lookupFolder(id)
+		if err != nil {
+			return err
+		}
+		parentPath := ""
+		if id != folderID {
+			parentPath = paths[folder.Parent]
+		}
+		name, err := builder.uniqueName(parentPath, folder.Name)
+		if err != nil {
+			return err
+		}
+		paths[id] = name + "/"
+		builder.entries = append(builder.entries, zipEntry{Name: paths[id], IsFolder: true})
+
+		objectIDs, err := queryObjectIDs(db, "SELECT object_id FROM files WHERE folder_id = ? AND username = owner ORDER BY filename", id)
+		if err != nil {
+			return err
+		}
+		for _, objectID := range objectIDs {
+			err = builder.addFile(objectID, paths[id])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Handle requests to /download: send the selected files and folders as a
+// ZIP archive
+func downloadZip(response http.ResponseWriter, request *http.Request, username string) {
+	err := request.ParseForm()
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+	objectIDs := request.Form["file"]
+	folderIDs := request.Form["folder"]
+	if len(objectIDs) == 0 && len(folderIDs) == 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "no files selected")
+		return
+	}
+
+	builder := &zipBuilder{username: username, names: make(map[string]bool)}
+	selected := make(map[string]bool)
+	for _, folderID := range folderIDs {
+		if selected[folderID] {
+			continue
+		}
+		selected[folderID] = true
+		err = builder.addFolder(folderID)
+		if err != nil {
+			break
+		}
+	}
+	for _, objectID := range objectIDs {
+		if err != nil || selected[objectID] {
+			continue
+		}
+		selected[objectID] = true
+		err = builder.addFile(objectID, "")
+	}
+	if err == sql.ErrNoRows {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "not authorized to download")
+		return
+	} else if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(response, err.Error())
+		return
+	}
+
+	// a single folder is named after itself
+	archiveName := "files.zip"
+	if len(folderIDs) == 1 && len(objectIDs) == 0 {
+		archiveName = strings.TrimSuffix(builder.entries[0].Name, "/") + ".zip"
+	}
+	setNameOfServedFile(response, archiveName)
+	response.Header().Set("Content-Type", "application/zip")
+
+	// once the archive has started, errors can only cut it short
+	err = writeZip(response, builder.entries)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Write a ZIP archive of the given entries
+func writeZip(writer io.Writer, entries []zipEntry) error {
+	archive := zip.NewWriter(writer)
+	for _, entry := range entries {
+		if entry.IsFolder {
+			_, err := archive.Create(entry.Name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		header := &zip.FileHeader{Name: entry.Name, Method: zip.Deflate, Modified: entry.File.Modified}
+		entryWriter, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		err = copyBlob(entryWriter, entry.File.Checksum)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// Copy the contents of a blob to a writer
+func copyBlob(writer io.Writer, digest string) error {
+	blob, err := os.Open(blobPath(digest))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	_, err = io.Copy(writer, blob)
+	return err
+}